@@ -0,0 +1,138 @@
+// Copyright 2018 The go-usechain Authors
+// This file is part of the go-usechain library.
+//
+// The go-usechain library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-usechain library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-usechain library. If not, see <http://www.gnu.org/licenses/>.
+
+package ABaccount
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/usechain/go-usechain/accounts"
+	"github.com/usechain/go-usechain/common"
+	"github.com/usechain/go-usechain/common/hexutil"
+	"github.com/usechain/go-usechain/crypto"
+)
+
+// attestationTag prefixes the canonical encoding of an attestation, versioning
+// the format and separating it from other signed messages.
+const attestationTag = "usechain account attestation v1"
+
+var (
+	ErrAttestationSigner = errors.New("attestation not signed by the expected account")
+	ErrAttestationNonce  = errors.New("attestation nonce mismatch")
+)
+
+// AttestedAccount is a single account listed by an attestation.
+type AttestedAccount struct {
+	Address   common.Address `json:"address"`
+	ABaddress hexutil.Bytes  `json:"abaddress,omitempty"` // Empty if the key file carries none
+}
+
+// AccountAttestation is a signed statement of the accounts held by a keystore.
+type AccountAttestation struct {
+	Accounts  []AttestedAccount `json:"accounts"` // Sorted by address
+	Timestamp uint64            `json:"timestamp"`
+	Nonce     hexutil.Bytes     `json:"nonce"`
+	Signer    common.Address    `json:"signer"`
+	Signature hexutil.Bytes     `json:"signature"`
+}
+
+// AttestAccounts lists every account of the keystore along with the AB address
+// of its key file, and signs the list with the signer account, which is
+// decrypted with the passphrase for this signature only. The nonce is chosen by
+// the counterparty to prove the attestation is fresh.
+func (ks *KeyStore) AttestAccounts(signer accounts.Account, passphrase string, nonce []byte) (*AccountAttestation, error) {
+	att := &AccountAttestation{
+		Timestamp: uint64(time.Now().Unix()),
+		Nonce:     common.CopyBytes(nonce),
+		Signer:    signer.Address,
+	}
+	for _, a := range ks.Accounts() {
+		header, err := readKeyFileHeader(a.URL.Path)
+		if err != nil {
+			return nil, err
+		}
+		attested := AttestedAccount{Address: a.Address}
+		if ab := common.FromHex(header.ABaddress); len(bytes.TrimLeft(ab, "\x00")) > 0 {
+			if len(ab) != common.ABaddressLength {
+				return nil, fmt.Errorf("key file %s has an AB address of %d bytes", a.URL.Path, len(ab))
+			}
+			attested.ABaddress = ab
+		}
+		att.Accounts = append(att.Accounts, attested)
+	}
+	sort.Slice(att.Accounts, func(i, j int) bool {
+		return bytes.Compare(att.Accounts[i].Address[:], att.Accounts[j].Address[:]) < 0
+	})
+	sig, err := ks.SignHashWithPassphrase(signer, passphrase, MsgHash(att.encode()))
+	if err != nil {
+		return nil, err
+	}
+	att.Signature = sig
+	return att, nil
+}
+
+// VerifyAccountAttestation checks that the attestation carries the expected
+// nonce and was signed by the given account.
+func VerifyAccountAttestation(att *AccountAttestation, signer common.Address, nonce []byte) error {
+	if !bytes.Equal(att.Nonce, nonce) {
+		return ErrAttestationNonce
+	}
+	if att.Signer != signer {
+		return ErrAttestationSigner
+	}
+	pub, err := crypto.SigToPub(MsgHash(att.encode()), att.Signature)
+	if err != nil {
+		return err
+	}
+	if crypto.PubkeyToAddress(*pub) != signer {
+		return ErrAttestationSigner
+	}
+	return nil
+}
+
+// encode returns the canonical encoding the attestation is signed over:
+//
+//	tag || signer || timestamp (8 bytes) || len(nonce) (4 bytes) || nonce ||
+//	len(accounts) (4 bytes) || for every account: address || len(ABaddress) (1 byte) || ABaddress
+//
+// Integers are big-endian. The encoding is pinned by tests and must not change
+// without bumping the tag.
+func (att *AccountAttestation) encode() []byte {
+	var (
+		buf bytes.Buffer
+		num [8]byte
+	)
+	buf.WriteString(attestationTag)
+	buf.Write(att.Signer[:])
+	binary.BigEndian.PutUint64(num[:], att.Timestamp)
+	buf.Write(num[:])
+	binary.BigEndian.PutUint32(num[:4], uint32(len(att.Nonce)))
+	buf.Write(num[:4])
+	buf.Write(att.Nonce)
+	binary.BigEndian.PutUint32(num[:4], uint32(len(att.Accounts)))
+	buf.Write(num[:4])
+	for _, a := range att.Accounts {
+		buf.Write(a.Address[:])
+		buf.WriteByte(byte(len(a.ABaddress)))
+		buf.Write(a.ABaddress)
+	}
+	return buf.Bytes()
+}
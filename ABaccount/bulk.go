@@ -0,0 +1,194 @@
+// Copyright 2018 The go-usechain Authors
+// This file is part of the go-usechain library.
+//
+// The go-usechain library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-usechain library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-usechain library. If not, see <http://www.gnu.org/licenses/>.
+
+package ABaccount
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+
+	"github.com/usechain/go-usechain/accounts"
+	"github.com/usechain/go-usechain/common"
+)
+
+// exportKey and importKeyJSON perform the per-key crypto of the bulk operations.
+// They are variables so tests can observe the progress of a bulk operation.
+var (
+	exportKey     = (*KeyStore).Export
+	importKeyJSON = (*KeyStore).Import
+)
+
+// ExportedKey is a single key produced by ExportAll.
+type ExportedKey struct {
+	Account accounts.Account
+	KeyJSON []byte
+}
+
+// ExportAll exports every account as a JSON key re-encrypted with newPassphrase.
+// At most workers keys are decrypted and encrypted concurrently, a non-positive
+// value meaning one worker per CPU.
+//
+// If ctx is cancelled or an export fails, no further keys are started and the
+// keys completed so far are returned, in account order, together with the error.
+func (ks *KeyStore) ExportAll(ctx context.Context, passphrase, newPassphrase string, workers int) ([]ExportedKey, error) {
+	accs := ks.Accounts()
+	keys := make([][]byte, len(accs))
+
+	done, err := runBounded(ctx, len(accs), workers, func(i int) error {
+		keyJSON, err := exportKey(ks, accs[i], passphrase, newPassphrase)
+		keys[i] = keyJSON
+		return err
+	})
+	exported := make([]ExportedKey, 0, len(accs))
+	for i, ok := range done {
+		if ok {
+			exported = append(exported, ExportedKey{Account: accs[i], KeyJSON: keys[i]})
+		}
+	}
+	return exported, err
+}
+
+// ImportAll imports the given JSON keys, re-encrypting them with newPassphrase.
+// Concurrency and cancellation behave as in ExportAll: the accounts imported
+// before the operation stopped are returned, in input order, with the error.
+// Keys are stored one at a time, so a key repeating an address of the batch
+// fails with ErrAccountAlreadyExists rather than writing a second key file.
+func (ks *KeyStore) ImportAll(ctx context.Context, keyJSONs [][]byte, passphrase, newPassphrase string, workers int) ([]accounts.Account, error) {
+	accs := make([]accounts.Account, len(keyJSONs))
+
+	done, err := runBounded(ctx, len(keyJSONs), workers, func(i int) error {
+		a, err := importKeyJSON(ks, keyJSONs[i], passphrase, newPassphrase)
+		accs[i] = a
+		return err
+	})
+	imported := make([]accounts.Account, 0, len(keyJSONs))
+	for i, ok := range done {
+		if ok {
+			imported = append(imported, accs[i])
+		}
+	}
+	return imported, err
+}
+
+// ImportResult is the outcome of importing a single key of a batch.
+type ImportResult struct {
+	Account accounts.Account // Imported account, zero if Err is set
+	Err     error
+}
+
+// DuplicateKeyError is reported for a key of a batch whose address was already
+// imported from an earlier key of the same batch.
+type DuplicateKeyError struct {
+	Addr  common.Address
+	Index int // Batch index of the key the address was imported from
+}
+
+func (err *DuplicateKeyError) Error() string {
+	return fmt.Sprintf("duplicate of key %d in the batch, address %x", err.Index, err.Addr)
+}
+
+// ImportBatch imports the given JSON keys, re-encrypting them with newPassphrase,
+// and reports the outcome of every key in input order. Unlike ImportAll, a key
+// that fails doesn't stop the batch. Keys repeating an address of an earlier key
+// of the batch fail with a *DuplicateKeyError, keys whose address the keystore
+// already holds with ErrAccountAlreadyExists.
+//
+// Keys are decrypted on at most workers goroutines and stored one by one. If ctx
+// is cancelled, the keys not processed yet fail with the context error, which is
+// also returned.
+func (ks *KeyStore) ImportBatch(ctx context.Context, keyJSONs [][]byte, passphrase, newPassphrase string, workers int) ([]ImportResult, error) {
+	results := make([]ImportResult, len(keyJSONs))
+	keys := make([]*Key, len(keyJSONs))
+
+	done, err := runBounded(ctx, len(keyJSONs), workers, func(i int) error {
+		keys[i], results[i].Err = decryptKeyChecked(keyJSONs[i], passphrase)
+		return nil
+	})
+	imported := make(map[common.Address]int)
+	for i, key := range keys {
+		switch {
+		case !done[i]:
+			results[i].Err = err
+			continue
+		case key == nil:
+			continue
+		}
+		if first, ok := imported[key.Address]; ok {
+			results[i].Err = &DuplicateKeyError{Addr: key.Address, Index: first}
+		} else if results[i].Account, results[i].Err = ks.importKey(key, newPassphrase, false); results[i].Err == nil {
+			imported[key.Address] = i
+		}
+		zeroKey(key.PrivateKey)
+	}
+	return results, err
+}
+
+// runBounded calls fn for the indices [0, n) on at most workers goroutines. It
+// stops handing out indices once ctx is done or a call fails, and reports which
+// calls completed successfully along with the first error encountered.
+func runBounded(ctx context.Context, n, workers int, fn func(i int) error) ([]bool, error) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		done    = make([]bool, n)
+		indices = make(chan int)
+		errOnce sync.Once
+		failure error
+		wg      sync.WaitGroup
+	)
+	fail := func(err error) {
+		errOnce.Do(func() { failure = err })
+		cancel()
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				if ctx.Err() != nil {
+					continue
+				}
+				if err := fn(i); err != nil {
+					fail(err)
+					continue
+				}
+				done[i] = true
+			}
+		}()
+	}
+feed:
+	for i := 0; i < n; i++ {
+		select {
+		case indices <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(indices)
+	wg.Wait()
+
+	if failure == nil && ctx.Err() != nil {
+		// Cancelled by the caller rather than by a failing call
+		failure = ctx.Err()
+	}
+	return done, failure
+}
@@ -0,0 +1,106 @@
+// Copyright 2018 The go-usechain Authors
+// This file is part of the go-usechain library.
+//
+// The go-usechain library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-usechain library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-usechain library. If not, see <http://www.gnu.org/licenses/>.
+
+package ABaccount
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/usechain/go-usechain/accounts"
+	"github.com/usechain/go-usechain/common"
+	"github.com/usechain/go-usechain/crypto"
+)
+
+// abBundleVersion is the format version of bundles written by ExportABaccountBundle.
+const abBundleVersion = 1
+
+// abBundleChecksumLength is the length of the keccak256 prefix closing a bundle.
+const abBundleChecksumLength = 4
+
+var (
+	ErrNoABaddress     = errors.New("account has no AB address")
+	ErrBundleVersion   = errors.New("unsupported AB account bundle version")
+	ErrBundleChecksum  = errors.New("AB account bundle checksum mismatch")
+	ErrBundleABaddress = errors.New("AB account bundle address doesn't match its key")
+	errBundleTooShort  = errors.New("AB account bundle too short")
+)
+
+// ExportABaccountBundle packs the key of an AB account, re-encrypted with
+// newPassphrase, together with its AB address into a compact bundle suitable
+// for base64 or QR encoding:
+//
+//	version (1 byte) || AB address || key JSON || checksum (4 bytes)
+//
+// The checksum is the keccak256 prefix of everything before it.
+func (ks *KeyStore) ExportABaccountBundle(a accounts.Account, passphrase, newPassphrase string) ([]byte, error) {
+	_, key, err := ks.getDecryptedKey(a, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroKey(key.PrivateKey)
+
+	if key.ABaddress == (common.ABaddress{}) {
+		return nil, ErrNoABaddress
+	}
+	keyJSON, err := ks.encryptForExport(key, newPassphrase)
+	if err != nil {
+		return nil, err
+	}
+	bundle := make([]byte, 0, 1+common.ABaddressLength+len(keyJSON)+abBundleChecksumLength)
+	bundle = append(bundle, abBundleVersion)
+	bundle = append(bundle, key.ABaddress[:]...)
+	bundle = append(bundle, keyJSON...)
+	return append(bundle, crypto.Keccak256(bundle)[:abBundleChecksumLength]...), nil
+}
+
+// ImportABaccountBundle stores the key of a bundle produced by
+// ExportABaccountBundle, re-encrypting it with newPassphrase. The bundle version
+// and checksum are validated before anything is decrypted, and the AB address of
+// the bundle must match the one carried by its key.
+func (ks *KeyStore) ImportABaccountBundle(bundle []byte, passphrase, newPassphrase string) (accounts.Account, common.ABaddress, error) {
+	if len(bundle) < 1+common.ABaddressLength+abBundleChecksumLength {
+		return accounts.Account{}, common.ABaddress{}, errBundleTooShort
+	}
+	if bundle[0] != abBundleVersion {
+		return accounts.Account{}, common.ABaddress{}, ErrBundleVersion
+	}
+	body, checksum := bundle[:len(bundle)-abBundleChecksumLength], bundle[len(bundle)-abBundleChecksumLength:]
+	if !bytes.Equal(crypto.Keccak256(body)[:abBundleChecksumLength], checksum) {
+		return accounts.Account{}, common.ABaddress{}, ErrBundleChecksum
+	}
+	var ab common.ABaddress
+	copy(ab[:], body[1:1+common.ABaddressLength])
+
+	key, err := decryptKeyChecked(body[1+common.ABaddressLength:], passphrase)
+	if err != nil {
+		return accounts.Account{}, common.ABaddress{}, err
+	}
+	defer zeroKey(key.PrivateKey)
+
+	switch key.ABaddress {
+	case common.ABaddress{}:
+		key.ABaddress = ab
+	case ab:
+	default:
+		return accounts.Account{}, common.ABaddress{}, ErrBundleABaddress
+	}
+	a, err := ks.importKey(key, newPassphrase, false)
+	if err != nil {
+		return accounts.Account{}, common.ABaddress{}, err
+	}
+	return a, ab, nil
+}
@@ -0,0 +1,155 @@
+// Copyright 2018 The go-usechain Authors
+// This file is part of the go-usechain library.
+//
+// The go-usechain library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-usechain library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-usechain library. If not, see <http://www.gnu.org/licenses/>.
+
+package ABaccount
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/usechain/go-usechain/accounts"
+	"github.com/usechain/go-usechain/common"
+	"github.com/usechain/go-usechain/crypto"
+	"github.com/usechain/go-usechain/params"
+)
+
+// keyFileHeader is the non-secret part of an encrypted key file, parsed without
+// touching the ciphertext, salt or MAC.
+type keyFileHeader struct {
+	Address   string `json:"address"`
+	ABaddress string `json:"abaddress"`
+	Id        string `json:"id"`
+	Version   int    `json:"version"`
+	Crypto    struct {
+		Cipher    string                 `json:"cipher"`
+		KDF       string                 `json:"kdf"`
+		KDFParams map[string]interface{} `json:"kdfparams"`
+	} `json:"crypto"`
+}
+
+// readKeyFileHeader parses the non-secret fields of the key file at path.
+func readKeyFileHeader(path string) (*keyFileHeader, error) {
+	keyjson, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	header := new(keyFileHeader)
+	if err := json.Unmarshal(keyjson, header); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// publicKDFParams lists the key derivation parameters that are safe to disclose.
+// Salts are deliberately absent.
+var publicKDFParams = []string{"n", "r", "p", "c", "dklen", "prf"}
+
+// publicKDFParams returns the disclosable key derivation parameters of the key
+// file, or nil if it has none.
+func (h *keyFileHeader) publicKDFParams() map[string]interface{} {
+	var kdf map[string]interface{}
+	for _, name := range publicKDFParams {
+		if value, ok := h.Crypto.KDFParams[name]; ok {
+			if kdf == nil {
+				kdf = make(map[string]interface{})
+			}
+			kdf[name] = value
+		}
+	}
+	return kdf
+}
+
+// diagnosticsAccount is the redacted view of a single account's key file.
+type diagnosticsAccount struct {
+	Address    string                 `json:"address"`
+	ABaddress  string                 `json:"abaddress,omitempty"`
+	File       string                 `json:"file"`
+	Size       int64                  `json:"size"`
+	ModTime    time.Time              `json:"mtime"`
+	KeyVersion int                    `json:"keyVersion,omitempty"`
+	KDF        string                 `json:"kdf,omitempty"`
+	KDFParams  map[string]interface{} `json:"kdfParams,omitempty"`
+	Findings   []string               `json:"findings,omitempty"`
+}
+
+// diagnosticsBundle is the document produced by ExportDiagnostics.
+type diagnosticsBundle struct {
+	Version  string               `json:"version"`
+	Created  time.Time            `json:"created"`
+	KeyDir   string               `json:"keydir"`
+	Accounts []diagnosticsAccount `json:"accounts"`
+	Hash     string               `json:"hash"`
+}
+
+// ExportDiagnostics produces a JSON bundle describing the keystore for attaching
+// to support requests. It only contains non-sensitive data: addresses, AB
+// addresses, key file versions and KDF cost parameters, file sizes and mtimes,
+// and consistency findings between the account cache and the files on disk. No
+// ciphertext, salt, IV, MAC or any other crypto section bytes are included.
+//
+// The bundle embeds the package version and a content hash, the hex encoded
+// keccak256 of the bundle serialized with an empty hash field.
+func (ks *KeyStore) ExportDiagnostics() ([]byte, error) {
+	bundle := &diagnosticsBundle{
+		Version:  params.VersionWithMeta,
+		Created:  time.Now().UTC(),
+		KeyDir:   ks.storage.JoinPath(""),
+		Accounts: []diagnosticsAccount{},
+	}
+	for _, a := range ks.Accounts() {
+		bundle.Accounts = append(bundle.Accounts, ks.diagnoseAccount(a))
+	}
+	blob, err := json.Marshal(bundle)
+	if err != nil {
+		return nil, err
+	}
+	bundle.Hash = hex.EncodeToString(crypto.Keccak256(blob))
+	return json.MarshalIndent(bundle, "", "  ")
+}
+
+// diagnoseAccount collects the redacted diagnostics of a single account.
+func (ks *KeyStore) diagnoseAccount(a accounts.Account) diagnosticsAccount {
+	diag := diagnosticsAccount{
+		Address: a.Address.Hex(),
+		File:    filepath.Base(a.URL.Path),
+	}
+	info, err := os.Stat(a.URL.Path)
+	if err != nil {
+		diag.Findings = append(diag.Findings, fmt.Sprintf("cached account has no readable key file: %v", err))
+		return diag
+	}
+	diag.Size, diag.ModTime = info.Size(), info.ModTime().UTC()
+
+	header, err := readKeyFileHeader(a.URL.Path)
+	if err != nil {
+		diag.Findings = append(diag.Findings, fmt.Sprintf("key file is not valid JSON: %v", err))
+		return diag
+	}
+	diag.KeyVersion, diag.KDF = header.Version, header.Crypto.KDF
+	diag.KDFParams = header.publicKDFParams()
+	if !common.IsHexAddress(header.Address) || common.HexToAddress(header.Address) != a.Address {
+		diag.Findings = append(diag.Findings, fmt.Sprintf("key file address %q does not match the cached account", header.Address))
+	}
+	if _, key, err := ks.getEncryptedKey(a); err == nil && key.ABaddress != (common.ABaddress{}) {
+		diag.ABaddress = hex.EncodeToString(key.ABaddress[:])
+	}
+	return diag
+}
@@ -0,0 +1,117 @@
+// Copyright 2018 The go-usechain Authors
+// This file is part of the go-usechain library.
+//
+// The go-usechain library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-usechain library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-usechain library. If not, see <http://www.gnu.org/licenses/>.
+
+package ABaccount
+
+import (
+	"container/heap"
+	"time"
+)
+
+// expiryHeap orders the timed unlocks by deadline. Every entry tracks its own
+// position, so a lock or re-unlock removes it without a search. The heap is
+// guarded by ks.mu.
+type expiryHeap []*unlocked
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expires.Before(h[j].expires) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	u := x.(*unlocked)
+	u.index = len(*h)
+	*h = append(*h, u)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	u := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	u.index = -1
+	return u
+}
+
+// scheduleExpiry queues a timed unlock for dropping at its deadline, starting
+// the expiry loop if it isn't running. The caller must hold ks.mu for writing.
+func (ks *KeyStore) scheduleExpiry(u *unlocked) {
+	if ks.expiryWake == nil {
+		ks.expiryWake = make(chan struct{}, 1)
+	}
+	heap.Push(&ks.expiries, u)
+	if !ks.expiring {
+		ks.expiring = true
+		go ks.expireLoop(ks.expiryWake)
+		return
+	}
+	if u.index == 0 {
+		ks.wakeExpiry()
+	}
+}
+
+// cancelExpiry removes a timed unlock from the expiry queue. The caller must hold
+// ks.mu for writing.
+func (ks *KeyStore) cancelExpiry(u *unlocked) {
+	if u.index < 0 {
+		return
+	}
+	head := u.index == 0
+	heap.Remove(&ks.expiries, u.index)
+	if head {
+		// Let the loop pick up the new deadline, or exit if none is left
+		ks.wakeExpiry()
+	}
+}
+
+// wakeExpiry makes the expiry loop re-read the earliest deadline.
+func (ks *KeyStore) wakeExpiry() {
+	select {
+	case ks.expiryWake <- struct{}{}:
+	default:
+	}
+}
+
+// expireLoop drops timed unlocks as their deadlines pass. A single loop serves
+// all timed unlocks of the keystore and returns once none are queued, so the
+// number of goroutines doesn't grow with the number of unlocks.
+func (ks *KeyStore) expireLoop(wake chan struct{}) {
+	for {
+		ks.mu.Lock()
+		now := time.Now()
+		for len(ks.expiries) > 0 && !ks.expiries[0].expires.After(now) {
+			u := ks.expiries[0]
+			ks.dropUnlocked(u.Address, u)
+		}
+		if len(ks.expiries) == 0 {
+			ks.expiring = false
+			ks.mu.Unlock()
+			return
+		}
+		timer := time.NewTimer(ks.expiries[0].expires.Sub(now))
+		ks.mu.Unlock()
+
+		select {
+		case <-timer.C:
+		case <-wake:
+			timer.Stop()
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2018 The go-usechain Authors
+// This file is part of the go-usechain library.
+//
+// The go-usechain library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-usechain library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-usechain library. If not, see <http://www.gnu.org/licenses/>.
+
+package ABaccount
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pborman/uuid"
+	"github.com/usechain/go-usechain/accounts"
+)
+
+// KeyFileInfo describes the encryption of a key file, read without decrypting it.
+type KeyFileInfo struct {
+	Account      accounts.Account
+	Version      int                    // Key file format version
+	Cipher       string                 // Symmetric cipher of the crypto section
+	KDF          string                 // Key derivation function, scrypt or pbkdf2
+	KDFParams    map[string]interface{} // Key derivation cost parameters, without the salt
+	HasABaddress bool                   // Whether the key file carries an AB address
+	ModTime      time.Time              // Last modification time of the key file
+	Err          error                  // Reason the file could not be read, set by KeyFileInfos
+}
+
+// KeyFileInfo returns the version, KDF and cipher parameters of the key file
+// backing the given account.
+func (ks *KeyStore) KeyFileInfo(a accounts.Account) (KeyFileInfo, error) {
+	a, err := ks.Find(a)
+	if err != nil {
+		return KeyFileInfo{Account: a}, err
+	}
+	return readKeyFileInfo(a)
+}
+
+// KeyFileInfos returns the key file details of every account in the keystore,
+// in the order of Accounts. Key files that cannot be parsed are reported with
+// their Err field set instead of failing the whole listing.
+func (ks *KeyStore) KeyFileInfos() []KeyFileInfo {
+	accs := ks.Accounts()
+	infos := make([]KeyFileInfo, len(accs))
+	for i, a := range accs {
+		info, err := readKeyFileInfo(a)
+		info.Err = err
+		infos[i] = info
+	}
+	return infos
+}
+
+// AccountID returns the UUID stored in the key file of the given account, read
+// without decrypting the key.
+func (ks *KeyStore) AccountID(a accounts.Account) (string, error) {
+	a, err := ks.Find(a)
+	if err != nil {
+		return "", err
+	}
+	header, err := readKeyFileHeader(a.URL.Path)
+	if err != nil {
+		return "", err
+	}
+	if header.Id == "" {
+		return "", fmt.Errorf("key file %s has no id", a.URL.Path)
+	}
+	id := uuid.Parse(header.Id)
+	if id == nil {
+		return "", fmt.Errorf("key file %s has a malformed id %q", a.URL.Path, header.Id)
+	}
+	return id.String(), nil
+}
+
+// AccountChecksummed returns the account for presentation, with the address in
+// its key file name spelled in EIP-55 checksummed form. The key file isn't
+// renamed, so the returned URL is for display only and doesn't resolve through
+// Find. Accounts whose file name doesn't hold the address are returned as is.
+func (ks *KeyStore) AccountChecksummed(a accounts.Account) accounts.Account {
+	lower := hex.EncodeToString(a.Address[:])
+	dir, name := filepath.Split(a.URL.Path)
+	if i := strings.LastIndex(strings.ToLower(name), lower); i >= 0 {
+		name = name[:i] + a.Address.Hex()[2:] + name[i+len(lower):]
+		a.URL.Path = dir + name
+	}
+	return a
+}
+
+// readKeyFileInfo parses the non-secret header of the account's key file.
+func readKeyFileInfo(a accounts.Account) (KeyFileInfo, error) {
+	info := KeyFileInfo{Account: a}
+
+	stat, err := os.Stat(a.URL.Path)
+	if err != nil {
+		return info, err
+	}
+	info.ModTime = stat.ModTime()
+
+	header, err := readKeyFileHeader(a.URL.Path)
+	if err != nil {
+		return info, err
+	}
+	info.Version, info.Cipher, info.KDF = header.Version, header.Crypto.Cipher, header.Crypto.KDF
+	info.KDFParams = header.publicKDFParams()
+	info.HasABaddress = strings.TrimLeft(strings.TrimPrefix(header.ABaddress, "0x"), "0") != ""
+	return info, nil
+}
@@ -21,18 +21,24 @@
 package ABaccount
 
 import (
+	"bytes"
 	"crypto/ecdsa"
 	crand "crypto/rand"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"math/big"
 	"os"
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	lru "github.com/hashicorp/golang-lru"
 	"github.com/usechain/go-usechain/accounts"
 	"github.com/usechain/go-usechain/common"
 	"github.com/usechain/go-usechain/common/hexutil"
@@ -42,8 +48,6 @@ import (
 	"github.com/usechain/go-usechain/crypto"
 	"github.com/usechain/go-usechain/event"
 
-	"github.com/usechain/go-usechain/core/state"
-
 	"encoding/hex"
 )
 
@@ -51,6 +55,11 @@ var (
 	ErrLocked  = accounts.NewAuthNeededError("password or unlock")
 	ErrNoMatch = errors.New("no key for given address or file")
 	ErrDecrypt = errors.New("could not decrypt key with given passphrase")
+
+	ErrAccountAlreadyExists = errors.New("account already exists")
+	ErrAddressMismatch      = errors.New("key file address doesn't match the decrypted key")
+
+	ErrRingTooSmall = errors.New("public key set smaller than the minimum ring size")
 )
 
 // KeyStoreType is the reflect type of a keystore backend.
@@ -62,6 +71,62 @@ var KeyStoreScheme = "keystore"
 // Maximum time between wallet refreshes (if filesystem notifications don't work).
 const walletRefreshCycle = 3 * time.Second
 
+const (
+	defaultMinRingSize = 1  // Ring signatures are produced over any non-empty set by default
+	maxMinRingSize     = 64 // Upper bound on the configurable anonymity floor
+
+	defaultABCacheSize = 64 // Number of compressed A points kept for AB derivations
+)
+
+// PubSetReader is the subset of the state database used to fetch the public
+// key sets ring signatures are produced over.
+type PubSetReader interface {
+	GetOneTimePubSet(contract common.Address, slot int) (string, error)
+}
+
+// PubSetSlotError is returned by GetOneTimePubSets when reading a slot fails.
+type PubSetSlotError struct {
+	Slot int
+	Err  error
+}
+
+func (err *PubSetSlotError) Error() string {
+	return fmt.Sprintf("reading public key set of slot %d: %v", err.Slot, err.Err)
+}
+
+// GetOneTimePubSets reads the public key sets of several slots in one pass,
+// keyed by slot. If a read fails, the sets read so far are returned along with
+// a *PubSetSlotError naming the slot.
+func GetOneTimePubSets(statedb PubSetReader, contract common.Address, slots []int) (map[int]string, error) {
+	sets := make(map[int]string, len(slots))
+	for _, slot := range slots {
+		if _, ok := sets[slot]; ok {
+			continue
+		}
+		set, err := statedb.GetOneTimePubSet(contract, slot)
+		if err != nil {
+			return sets, &PubSetSlotError{Slot: slot, Err: err}
+		}
+		sets[slot] = set
+	}
+	return sets, nil
+}
+
+// PassphraseProvider returns the passphrase for the key of the given address on
+// demand, typically backed by an OS keyring or a vault agent.
+type PassphraseProvider func(addr common.Address) (string, error)
+
+// PassphraseProviderError is returned when the registered passphrase provider
+// fails to supply a passphrase for an account.
+type PassphraseProviderError struct {
+	Addr common.Address
+	Err  error
+}
+
+func (err *PassphraseProviderError) Error() string {
+	return fmt.Sprintf("passphrase provider failed for %x: %v", err.Addr, err.Err)
+}
+
 // KeyStore manages a key storage directory on disk.
 type KeyStore struct {
 	storage  keyStore                     // Storage backend, might be cleartext or encrypted
@@ -74,15 +139,33 @@ type KeyStore struct {
 	updateScope event.SubscriptionScope // Subscription scope tracking current live listeners
 	updating    bool                    // Whether the event notification loop is running
 
-	mu sync.RWMutex
+	minRingSize int                // Minimum number of public keys a ring signature must cover
+	provider    PassphraseProvider // Optional source of passphrases for signing locked accounts
+	ringDomain  []byte             // Domain tag prefixed to ring signature messages
+	sealMaxAge  time.Duration      // Maximum age of a sealed unlocked state accepted for restoring
+	abCache     *lru.Cache         // Compressed public keys of unlocked accounts, nil if disabled
+	policy      Policy             // Optional authorization of key operations per account
+	signers     sync.Map           // EIP155 signers by decimal chain ID
+
+	expiries   expiryHeap    // Timed unlocks ordered by deadline
+	expiryWake chan struct{} // Notifies the expiry loop of a changed earliest deadline
+	expiring   bool          // Whether the expiry loop is running
+
+	err error // Error opening the keystore directory, nil if it is usable
+
+	mu       sync.RWMutex
+	importMu sync.Mutex // Makes the address check and the key file write of an import atomic
 }
 
 type unlocked struct {
 	*Key
-	abort chan struct{}
+	expires time.Time // Time the key is dropped at, zero if unlocked indefinitely
+	index   int       // Position in the expiry heap, -1 if not queued
 }
 
-// NewKeyStore creates a keystore for the given directory.
+// NewKeyStore creates a keystore for the given directory. A missing directory is
+// created with mode 0700. If the directory can't be created or read, the keystore
+// starts out without accounts and the failure is reported by Err.
 func NewKeyStore(keydir string, scryptN, scryptP int) *KeyStore {
 	keydir, _ = filepath.Abs(keydir)
 	ks := &KeyStore{storage: &keyStorePassphrase{keydir, scryptN, scryptP}}
@@ -104,8 +187,13 @@ func (ks *KeyStore) init(keydir string) {
 	ks.mu.Lock()
 	defer ks.mu.Unlock()
 
+	ks.err = openKeyDir(keydir)
+
 	// Initialize the set of unlocked keys and the account cache
 	ks.unlocked = make(map[common.Address]*unlocked)
+	ks.minRingSize = defaultMinRingSize
+	ks.sealMaxAge = defaultSealMaxAge
+	ks.abCache, _ = lru.New(defaultABCacheSize)
 	ks.cache, ks.changes = newAccountCache(keydir)
 
 	// TODO: In order for this finalizer to work, there must be no references
@@ -122,6 +210,32 @@ func (ks *KeyStore) init(keydir string) {
 	}
 }
 
+// openKeyDir creates the keystore directory if missing and checks it is readable.
+func openKeyDir(keydir string) error {
+	if err := os.MkdirAll(keydir, 0700); err != nil {
+		return err
+	}
+	dir, err := os.Open(keydir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	if _, err := dir.Readdirnames(1); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// Err returns the error encountered opening the keystore directory, e.g. missing
+// permissions, or nil if the directory is usable.
+func (ks *KeyStore) Err() error {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	return ks.err
+}
+
 // Wallets implements accounts.Backend, returning all single-key wallets from the
 // keystore directory.
 func (ks *KeyStore) Wallets() []accounts.Wallet {
@@ -136,6 +250,29 @@ func (ks *KeyStore) Wallets() []accounts.Wallet {
 	return cpy
 }
 
+// WalletByAddress returns the wallet wrapping the key file of the given address,
+// the same instance listed by Wallets. It fails with ErrNoMatch if no key file
+// holds the address, or with an *AmbiguousAddrError if several do.
+func (ks *KeyStore) WalletByAddress(addr common.Address) (accounts.Wallet, error) {
+	a, err := ks.Find(accounts.Account{Address: addr})
+	if err != nil {
+		return nil, err
+	}
+	ks.refreshWallets()
+
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	// Wallets are kept sorted by URL, look the account's one up directly
+	i := sort.Search(len(ks.wallets), func(i int) bool {
+		return ks.wallets[i].URL().Cmp(a.URL) >= 0
+	})
+	if i < len(ks.wallets) && ks.wallets[i].URL() == a.URL {
+		return ks.wallets[i], nil
+	}
+	return nil, ErrNoMatch
+}
+
 // refreshWallets retrieves the current account list and based on that does any
 // necessary wallet refreshes.
 func (ks *KeyStore) refreshWallets() {
@@ -235,9 +372,139 @@ func (ks *KeyStore) Accounts() []accounts.Account {
 	return ks.cache.accounts()
 }
 
+// ForEachAccount calls fn for every account in the keystore, in URL order,
+// stopping early if fn returns false. Unlike Accounts it does not copy the
+// account list; iteration runs under the account cache lock, so the set seen
+// is consistent but fn must not call back into the keystore.
+func (ks *KeyStore) ForEachAccount(fn func(accounts.Account) bool) {
+	ks.cache.maybeReload()
+	ks.cache.mu.Lock()
+	defer ks.cache.mu.Unlock()
+
+	for _, a := range ks.cache.all {
+		if !fn(a) {
+			return
+		}
+	}
+}
+
+// ForEachWallet calls fn for every wallet in the keystore, stopping early if fn
+// returns false. Unlike Wallets it does not copy the wallet list; iteration runs
+// under the keystore read lock, so fn must not call back into the keystore.
+func (ks *KeyStore) ForEachWallet(fn func(accounts.Wallet) bool) {
+	// Make sure the list of wallets is in sync with the account cache
+	ks.refreshWallets()
+
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	for _, w := range ks.wallets {
+		if !fn(w) {
+			return
+		}
+	}
+}
+
+// AccountsIterator steps over the keystore accounts for callers that need to
+// interleave other work, including keystore calls, with the iteration. It
+// operates on a snapshot taken at creation time, so accounts added or removed
+// afterwards by cache reloads are not reflected.
+type AccountsIterator struct {
+	accounts []accounts.Account
+	index    int
+}
+
+// AccountsIterator returns an iterator positioned before the first account.
+func (ks *KeyStore) AccountsIterator() *AccountsIterator {
+	return &AccountsIterator{accounts: ks.cache.accounts(), index: -1}
+}
+
+// Next advances the iterator, reporting whether an account is available.
+func (it *AccountsIterator) Next() bool {
+	if it.index < len(it.accounts) {
+		it.index++
+	}
+	return it.index < len(it.accounts)
+}
+
+// Value returns the account at the current position of the iterator.
+func (it *AccountsIterator) Value() accounts.Account {
+	return it.accounts[it.index]
+}
+
+// AuditReason classifies why a key file failed to decrypt during an audit.
+type AuditReason int
+
+const (
+	AuditDecrypt   AuditReason = iota // Key file is intact but the passphrase doesn't open it
+	AuditIO                           // Key file could not be read from disk
+	AuditMalformed                    // Key file contents are not a valid encrypted key
+)
+
+// AuditFailure describes a single key file that failed an audit sweep.
+type AuditFailure struct {
+	Account accounts.Account // Account whose key file failed
+	Reason  AuditReason      // Classification of the failure
+	Err     error            // Underlying error reported by the storage backend
+}
+
+// AuditDecryptable attempts to decrypt every key in the keystore with the given
+// passphrase, reporting which accounts succeeded and which failed along with the
+// reason. Successfully decrypted keys are zeroed immediately.
+func (ks *KeyStore) AuditDecryptable(passphrase string) (ok []common.Address, failed []AuditFailure, err error) {
+	for _, a := range ks.Accounts() {
+		key, err := ks.storage.GetKey(a.Address, a.URL.Path, passphrase)
+		if key != nil && key.PrivateKey != nil {
+			zeroKey(key.PrivateKey)
+		}
+		switch err.(type) {
+		case nil:
+			ok = append(ok, a.Address)
+		case *os.PathError:
+			failed = append(failed, AuditFailure{Account: a, Reason: AuditIO, Err: err})
+		default:
+			reason := AuditMalformed
+			if err == ErrDecrypt {
+				reason = AuditDecrypt
+			}
+			failed = append(failed, AuditFailure{Account: a, Reason: reason, Err: err})
+		}
+	}
+	return ok, failed, nil
+}
+
 // Delete deletes the key matched by account if the passphrase is correct.
 // If the account contains no filename, the address must match a unique key.
 func (ks *KeyStore) Delete(a accounts.Account, passphrase string) error {
+	err := ks.deleteKey(a, passphrase)
+	if err == nil {
+		ks.refreshWallets()
+	}
+	return err
+}
+
+// DeleteBatch deletes the keys matched by the accounts whose key opens with the
+// passphrase, reporting which were deleted and which failed. A wrong passphrase
+// or a missing key file fails that account only, the rest of the batch goes on.
+// Deleted accounts are locked, and the wallets are refreshed once at the end.
+func (ks *KeyStore) DeleteBatch(accs []accounts.Account, passphrase string) (deleted []common.Address, failed []common.Address, err error) {
+	for _, a := range accs {
+		if err := ks.deleteKey(a, passphrase); err != nil {
+			failed = append(failed, a.Address)
+			continue
+		}
+		ks.Lock(a.Address)
+		deleted = append(deleted, a.Address)
+	}
+	if len(deleted) > 0 {
+		ks.refreshWallets()
+	}
+	return deleted, failed, nil
+}
+
+// deleteKey removes the key file and cache entry of an account after checking
+// the passphrase, without refreshing the wallets.
+func (ks *KeyStore) deleteKey(a accounts.Account, passphrase string) error {
 	// Decrypting the key isn't really necessary, but we do
 	// it anyway to check the password and zero out the key
 	// immediately afterwards.
@@ -251,50 +518,186 @@ func (ks *KeyStore) Delete(a accounts.Account, passphrase string) error {
 	// The order is crucial here. The key is dropped from the
 	// cache after the file is gone so that a reload happening in
 	// between won't insert it into the cache again.
-	err = os.Remove(a.URL.Path)
-	if err == nil {
-		ks.cache.delete(a)
-		ks.refreshWallets()
+	if err := os.Remove(a.URL.Path); err != nil {
+		return err
 	}
-	return err
+	ks.cache.delete(a)
+	return nil
 }
 
 // SignHash calculates a ECDSA signature for the given hash. The produced
 // signature is in the [R || S || V] format where V is 0 or 1.
+//
+// If the account is locked and a passphrase provider is registered, the key is
+// decrypted for this signature only and zeroed afterwards.
 func (ks *KeyStore) SignHash(a accounts.Account, hash []byte) ([]byte, error) {
+	if err := ks.checkPolicy(a, OpDescriptor{Type: OpSignHash}); err != nil {
+		return nil, err
+	}
 	// Look up the key to sign with and abort if it cannot be found
+	if priv, found := ks.unlockedKeyCopy(a.Address); found {
+		defer zeroKey(priv)
+		// Sign the hash using plain ECDSA operations
+		return crypto.Sign(hash, priv)
+	}
+
+	key, err := ks.provideKey(a)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroKey(key.PrivateKey)
+	return crypto.Sign(hash, key.PrivateKey)
+}
+
+// unlockedKeyCopy returns a copy of the unlocked private key of the address,
+// taken under ks.mu so that a concurrent Lock or expiry zeroing the original
+// can't affect a signature in progress. The caller must zero the copy.
+func (ks *KeyStore) unlockedKeyCopy(addr common.Address) (*ecdsa.PrivateKey, bool) {
 	ks.mu.RLock()
 	defer ks.mu.RUnlock()
 
+	u, found := ks.unlocked[addr]
+	if !found {
+		return nil, false
+	}
+	return copyKey(u.PrivateKey), true
+}
+
+// copyKey duplicates a private key, sharing only the immutable public point.
+func copyKey(k *ecdsa.PrivateKey) *ecdsa.PrivateKey {
+	return &ecdsa.PrivateKey{PublicKey: k.PublicKey, D: new(big.Int).Set(k.D)}
+}
+
+// SignHashOneTime signs the hash with a one-time key derived from the unlocked
+// key of the account, returning the signature in [R || S || V] format together
+// with the uncompressed derived public key.
+//
+// The one-time key is d' = (d + keccak256(tweak)) mod n, where d is the master
+// private key and n the secp256k1 group order. Its public half is
+// D' = D + keccak256(tweak)*G, so a verifier holding the master public key and
+// the tweak can reconstruct D' without learning anything about d.
+func (ks *KeyStore) SignHashOneTime(a accounts.Account, tweak []byte, hash []byte) ([]byte, []byte, error) {
+	if err := ks.checkPolicy(a, OpDescriptor{Type: OpSignHash}); err != nil {
+		return nil, nil, err
+	}
+	ks.mu.RLock()
 	unlockedKey, found := ks.unlocked[a.Address]
 	if !found {
-		return nil, ErrLocked
+		ks.mu.RUnlock()
+		return nil, nil, ErrLocked
+	}
+	priv, err := deriveOneTimeKey(unlockedKey.PrivateKey, tweak)
+	ks.mu.RUnlock()
+	if err != nil {
+		return nil, nil, err
 	}
-	// Sign the hash using plain ECDSA operations
-	return crypto.Sign(hash, unlockedKey.PrivateKey)
+	defer zeroKey(priv)
+
+	sig, err := crypto.Sign(hash, priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sig, crypto.FromECDSAPub(&priv.PublicKey), nil
+}
+
+// deriveOneTimeKey computes the one-time private key (d + keccak256(tweak)) mod n.
+func deriveOneTimeKey(master *ecdsa.PrivateKey, tweak []byte) (*ecdsa.PrivateKey, error) {
+	d := new(big.Int).SetBytes(crypto.Keccak256(tweak))
+	d.Add(d, master.D)
+	d.Mod(d, crypto.S256().Params().N)
+	if d.Sign() == 0 {
+		return nil, errors.New("one-time key derivation produced the zero scalar")
+	}
+	return crypto.ToECDSA(math.PaddedBigBytes(d, 32))
 }
 
 // SignTx signs the given transaction with the requested account.
+//
+// If the account is locked and a passphrase provider is registered, the key is
+// decrypted for this signature only and zeroed afterwards.
 func (ks *KeyStore) SignTx(a accounts.Account, tx *types.Transaction, chainID *big.Int) (*types.Transaction, error) {
+	if err := ks.checkPolicy(a, txOpDescriptor(tx, chainID)); err != nil {
+		return nil, err
+	}
 	// Look up the key to sign with and abort if it cannot be found
+	if priv, found := ks.unlockedKeyCopy(a.Address); found {
+		defer zeroKey(priv)
+		return ks.signTx(tx, chainID, priv)
+	}
+
+	key, err := ks.provideKey(a)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroKey(key.PrivateKey)
+	return ks.signTx(tx, chainID, key.PrivateKey)
+}
+
+// txOpDescriptor describes the signing of the transaction for the signing policy.
+func txOpDescriptor(tx *types.Transaction, chainID *big.Int) OpDescriptor {
+	return OpDescriptor{Type: OpSignTx, To: tx.To(), Value: tx.Value(), ChainID: chainID}
+}
+
+// signTx signs the transaction with EIP155 or homestead rules, depending on the
+// presence of the chain ID.
+func (ks *KeyStore) signTx(tx *types.Transaction, chainID *big.Int, priv *ecdsa.PrivateKey) (*types.Transaction, error) {
+	if chainID != nil {
+		return types.SignTx(tx, ks.eip155Signer(chainID), priv)
+	}
+	return types.SignTx(tx, types.HomesteadSigner{}, priv)
+}
+
+// eip155Signer returns the EIP155 signer of the chain ID, creating and caching it
+// on first use so repeated signing doesn't allocate a signer per transaction.
+func (ks *KeyStore) eip155Signer(chainID *big.Int) types.Signer {
+	id := chainID.String()
+	if signer, ok := ks.signers.Load(id); ok {
+		return signer.(types.Signer)
+	}
+	// Copy the chain ID, the caller may reuse or modify it
+	signer, _ := ks.signers.LoadOrStore(id, types.NewEIP155Signer(new(big.Int).Set(chainID)))
+	return signer.(types.Signer)
+}
+
+// SetPassphraseProvider registers a provider consulted by SignHash and SignTx
+// when the requested account is not unlocked. Keys decrypted this way are used
+// for a single signature and never inserted into the unlocked set. A nil
+// provider restores the default behavior of failing with ErrLocked.
+func (ks *KeyStore) SetPassphraseProvider(p PassphraseProvider) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	ks.provider = p
+}
+
+// provideKey decrypts the key of a locked account with a passphrase obtained
+// from the registered provider. The caller must zero the returned key.
+func (ks *KeyStore) provideKey(a accounts.Account) (*Key, error) {
 	ks.mu.RLock()
-	defer ks.mu.RUnlock()
+	provider := ks.provider
+	ks.mu.RUnlock()
 
-	unlockedKey, found := ks.unlocked[a.Address]
-	if !found {
+	if provider == nil {
 		return nil, ErrLocked
 	}
-	// Depending on the presence of the chain ID, sign with EIP155 or homestead
-	if chainID != nil {
-		return types.SignTx(tx, types.NewEIP155Signer(chainID), unlockedKey.PrivateKey)
+	passphrase, err := provider(a.Address)
+	if err != nil {
+		return nil, &PassphraseProviderError{Addr: a.Address, Err: err}
 	}
-	return types.SignTx(tx, types.HomesteadSigner{}, unlockedKey.PrivateKey)
+	_, key, err := ks.getDecryptedKey(a, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
 }
 
 // SignHashWithPassphrase signs hash if the private key matching the given address
 // can be decrypted with the given passphrase. The produced signature is in the
 // [R || S || V] format where V is 0 or 1.
 func (ks *KeyStore) SignHashWithPassphrase(a accounts.Account, passphrase string, hash []byte) (signature []byte, err error) {
+	if err := ks.checkPolicy(a, OpDescriptor{Type: OpSignHash}); err != nil {
+		return nil, err
+	}
 	_, key, err := ks.getDecryptedKey(a, passphrase)
 	if err != nil {
 		return nil, err
@@ -306,17 +709,16 @@ func (ks *KeyStore) SignHashWithPassphrase(a accounts.Account, passphrase string
 // SignTxWithPassphrase signs the transaction if the private key matching the
 // given address can be decrypted with the given passphrase.
 func (ks *KeyStore) SignTxWithPassphrase(a accounts.Account, passphrase string, tx *types.Transaction, chainID *big.Int) (*types.Transaction, error) {
+	if err := ks.checkPolicy(a, txOpDescriptor(tx, chainID)); err != nil {
+		return nil, err
+	}
 	_, key, err := ks.getDecryptedKey(a, passphrase)
 	if err != nil {
 		return nil, err
 	}
 	defer zeroKey(key.PrivateKey)
 
-	// Depending on the presence of the chain ID, sign with EIP155 or homestead
-	if chainID != nil {
-		return types.SignTx(tx, types.NewEIP155Signer(chainID), key.PrivateKey)
-	}
-	return types.SignTx(tx, types.HomesteadSigner{}, key.PrivateKey)
+	return ks.signTx(tx, chainID, key.PrivateKey)
 }
 
 // Unlock unlocks the given account indefinitely.
@@ -327,15 +729,31 @@ func (ks *KeyStore) Unlock(a accounts.Account, passphrase string) error {
 // Lock removes the private key with the given address from memory.
 func (ks *KeyStore) Lock(addr common.Address) error {
 	ks.mu.Lock()
-	if unl, found := ks.unlocked[addr]; found {
-		ks.mu.Unlock()
-		ks.expire(addr, unl, time.Duration(0)*time.Nanosecond)
-	} else {
-		ks.mu.Unlock()
+	defer ks.mu.Unlock()
+
+	if u, found := ks.unlocked[addr]; found {
+		ks.dropUnlocked(addr, u)
 	}
 	return nil
 }
 
+// dropUnlocked zeroes an unlocked key, removes it from the unlocked set and
+// cancels its expiry. The caller must hold ks.mu for writing.
+//
+// Entries leave the unlocked set only through this method and always together
+// with leaving the expiry queue, so no expiry ever fires for a replaced entry and
+// no zeroed key is ever left reachable for signing.
+func (ks *KeyStore) dropUnlocked(addr common.Address, u *unlocked) {
+	if !u.expires.IsZero() {
+		ks.cancelExpiry(u)
+	}
+	zeroKey(u.PrivateKey)
+	delete(ks.unlocked, addr)
+	if ks.abCache != nil {
+		ks.abCache.Remove(addr)
+	}
+}
+
 // TimedUnlock unlocks the given account with the passphrase. The account
 // stays unlocked for the duration of timeout. A timeout of 0 unlocks the account
 // until the program exits. The account must match a unique key file.
@@ -348,28 +766,45 @@ func (ks *KeyStore) TimedUnlock(a accounts.Account, passphrase string, timeout t
 	if err != nil {
 		return err
 	}
+	ks.unlockKey(a.Address, key, timeout)
+	return nil
+}
 
+// UnlockJSON decrypts the given JSON key in memory and unlocks its address for
+// the duration of timeout, with the same semantics as TimedUnlock. Nothing is
+// written to the key directory or added to the account cache, so the key is
+// gone once it is locked or expires.
+func (ks *KeyStore) UnlockJSON(keyJSON []byte, passphrase string, timeout time.Duration) (common.Address, error) {
+	key, err := decryptKeyChecked(keyJSON, passphrase)
+	if err != nil {
+		return common.Address{}, err
+	}
+	ks.unlockKey(key.Address, key, timeout)
+	return key.Address, nil
+}
+
+// unlockKey inserts the decrypted key into the unlocked set, replacing or keeping
+// an existing entry as documented on TimedUnlock.
+func (ks *KeyStore) unlockKey(addr common.Address, key *Key, timeout time.Duration) {
 	ks.mu.Lock()
 	defer ks.mu.Unlock()
-	u, found := ks.unlocked[a.Address]
+	u, found := ks.unlocked[addr]
 	if found {
-		if u.abort == nil {
+		if u.expires.IsZero() {
 			// The address was unlocked indefinitely, so unlocking
 			// it with a timeout would be confusing.
 			zeroKey(key.PrivateKey)
-			return nil
+			return
 		}
-		// Terminate the expire goroutine and replace it below.
-		close(u.abort)
+		// Cancel the pending expiry and replace it below.
+		ks.dropUnlocked(addr, u)
 	}
+	u = &unlocked{Key: key, index: -1}
 	if timeout > 0 {
-		u = &unlocked{Key: key, abort: make(chan struct{})}
-		go ks.expire(a.Address, u, timeout)
-	} else {
-		u = &unlocked{Key: key}
+		u.expires = time.Now().Add(timeout)
+		ks.scheduleExpiry(u)
 	}
-	ks.unlocked[a.Address] = u
-	return nil
+	ks.unlocked[addr] = u
 }
 
 // Find resolves the given account into a unique entry in the keystore.
@@ -387,7 +822,14 @@ func (ks *KeyStore) getDecryptedKey(a accounts.Account, auth string) (accounts.A
 		return a, nil, err
 	}
 	key, err := ks.storage.GetKey(a.Address, a.URL.Path, auth)
-	return a, key, err
+	if err != nil {
+		return a, key, err
+	}
+	if crypto.PubkeyToAddress(key.PrivateKey.PublicKey) != a.Address {
+		zeroKey(key.PrivateKey)
+		return a, nil, ErrAddressMismatch
+	}
+	return a, key, nil
 }
 
 func (ks *KeyStore) getEncryptedKey(a accounts.Account) (accounts.Account, *Key, error) {
@@ -402,27 +844,6 @@ func (ks *KeyStore) getEncryptedKey(a accounts.Account) (accounts.Account, *Key,
 	return a, key, nil
 }
 
-
-func (ks *KeyStore) expire(addr common.Address, u *unlocked, timeout time.Duration) {
-	t := time.NewTimer(timeout)
-	defer t.Stop()
-	select {
-	case <-u.abort:
-		// just quit
-	case <-t.C:
-		ks.mu.Lock()
-		// only drop if it's still the same key instance that dropLater
-		// was launched with. we can check that using pointer equality
-		// because the map stores a new pointer every time the key is
-		// unlocked.
-		if ks.unlocked[addr] == u {
-			zeroKey(u.PrivateKey)
-			delete(ks.unlocked, addr)
-		}
-		ks.mu.Unlock()
-	}
-}
-
 // NewAccount generates a new key and stores it into the key directory,
 // encrypting it with the passphrase.
 func (ks *KeyStore) NewAccount(passphrase string) (accounts.Account, error) {
@@ -443,6 +864,12 @@ func (ks *KeyStore) Export(a accounts.Account, passphrase, newPassphrase string)
 	if err != nil {
 		return nil, err
 	}
+	return ks.encryptForExport(key, newPassphrase)
+}
+
+// encryptForExport encrypts a decrypted key with the scrypt parameters of the
+// keystore, or the standard ones for plaintext keystores.
+func (ks *KeyStore) encryptForExport(key *Key, newPassphrase string) ([]byte, error) {
 	var N, P int
 	if store, ok := ks.storage.(*keyStorePassphrase); ok {
 		N, P = store.scryptN, store.scryptP
@@ -452,29 +879,81 @@ func (ks *KeyStore) Export(a accounts.Account, passphrase, newPassphrase string)
 	return EncryptKey(key, newPassphrase, N, P)
 }
 
-// Import stores the given encrypted JSON key into the key directory.
-func (ks *KeyStore) Import(keyJSON []byte, passphrase, newPassphrase string) (accounts.Account, error) {
-	key, err := DecryptKey(keyJSON, passphrase)
-	if key != nil && key.PrivateKey != nil {
-		defer zeroKey(key.PrivateKey)
+// ExportECDSA decrypts the key of the given account and returns the raw private
+// key. This is a dangerous operation: the key leaves the keystore unencrypted,
+// and the caller is responsible for zeroing it once done. The returned key is a
+// fresh decryption, never shared with the unlocked set.
+func (ks *KeyStore) ExportECDSA(a accounts.Account, passphrase string) (*ecdsa.PrivateKey, error) {
+	_, key, err := ks.getDecryptedKey(a, passphrase)
+	if err != nil {
+		return nil, err
 	}
+	return key.PrivateKey, nil
+}
+
+// Import stores the given encrypted JSON key into the key directory. It fails
+// with ErrAccountAlreadyExists if the keystore already holds the address.
+func (ks *KeyStore) Import(keyJSON []byte, passphrase, newPassphrase string) (accounts.Account, error) {
+	return ks.ImportKeyJSON(keyJSON, passphrase, newPassphrase, false)
+}
+
+// ImportKeyJSON stores the given encrypted JSON key into the key directory. If
+// the keystore already holds the address, the existing key file is replaced when
+// overwrite is set, otherwise ErrAccountAlreadyExists is returned.
+func (ks *KeyStore) ImportKeyJSON(keyJSON []byte, passphrase, newPassphrase string, overwrite bool) (accounts.Account, error) {
+	key, err := decryptKeyChecked(keyJSON, passphrase)
 	if err != nil {
 		return accounts.Account{}, err
 	}
-	return ks.importKey(key, newPassphrase)
+	defer zeroKey(key.PrivateKey)
+
+	return ks.importKey(key, newPassphrase, overwrite)
+}
+
+// decryptKeyChecked decrypts a JSON key and verifies that the address the key
+// file claims is the one derived from the decrypted private key.
+func decryptKeyChecked(keyJSON []byte, passphrase string) (*Key, error) {
+	key, err := DecryptKey(keyJSON, passphrase)
+	if err != nil {
+		if key != nil && key.PrivateKey != nil {
+			zeroKey(key.PrivateKey)
+		}
+		return nil, err
+	}
+	var header keyFileHeader
+	if err := json.Unmarshal(keyJSON, &header); err != nil {
+		zeroKey(key.PrivateKey)
+		return nil, err
+	}
+	derived := crypto.PubkeyToAddress(key.PrivateKey.PublicKey)
+	if key.Address != derived || (header.Address != "" && (!common.IsHexAddress(header.Address) || common.HexToAddress(header.Address) != derived)) {
+		zeroKey(key.PrivateKey)
+		return nil, ErrAddressMismatch
+	}
+	return key, nil
 }
 
 // ImportECDSA stores the given key into the key directory, encrypting it with the passphrase.
 func (ks *KeyStore) ImportECDSA(priv *ecdsa.PrivateKey, passphrase string) (accounts.Account, error) {
-	key := newKeyFromECDSA(priv)
-	if ks.cache.hasAddress(key.Address) {
-		return accounts.Account{}, fmt.Errorf("account already exists")
-	}
-	return ks.importKey(key, passphrase)
+	return ks.importKey(newKeyFromECDSA(priv), passphrase, false)
 }
 
-func (ks *KeyStore) importKey(key *Key, passphrase string) (accounts.Account, error) {
+func (ks *KeyStore) importKey(key *Key, passphrase string, overwrite bool) (accounts.Account, error) {
+	ks.importMu.Lock()
+	defer ks.importMu.Unlock()
+
 	a := accounts.Account{Address: key.Address, URL: accounts.URL{Scheme: KeyStoreScheme, Path: ks.storage.JoinPath(keyFileName(key.Address))}}
+	if ks.cache.hasAddress(key.Address) {
+		if !overwrite {
+			return accounts.Account{}, ErrAccountAlreadyExists
+		}
+		// Replace the existing key file rather than adding a second one
+		existing, err := ks.Find(accounts.Account{Address: key.Address})
+		if err != nil {
+			return accounts.Account{}, err
+		}
+		a = existing
+	}
 	if err := ks.storage.StoreKey(a.URL.Path, key, passphrase); err != nil {
 		return accounts.Account{}, err
 	}
@@ -494,7 +973,17 @@ func (ks *KeyStore) Update(a accounts.Account, passphrase, newPassphrase string)
 
 // ImportPreSaleKey decrypts the given Ethereum presale wallet and stores
 // a key file in the key directory. The key file is encrypted with the same passphrase.
+// It fails with ErrAccountAlreadyExists if the keystore already holds the address.
 func (ks *KeyStore) ImportPreSaleKey(keyJSON []byte, passphrase string) (accounts.Account, error) {
+	// The wallet states its address, which decryption verifies against the key
+	var wallet struct {
+		EthAddr string `json:"ethaddr"`
+	}
+	if err := json.Unmarshal(keyJSON, &wallet); err == nil && common.IsHexAddress(wallet.EthAddr) {
+		if ks.cache.hasAddress(common.HexToAddress(wallet.EthAddr)) {
+			return accounts.Account{}, ErrAccountAlreadyExists
+		}
+	}
 	a, _, err := importPreSaleKey(ks.storage, keyJSON, passphrase)
 	if err != nil {
 		return a, err
@@ -512,6 +1001,13 @@ func zeroKey(k *ecdsa.PrivateKey) {
 	}
 }
 
+// zeroBytes zeroes a byte slice holding key material.
+func zeroBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
 
 /////////////////////  greg: 2018/5/21  /////////////////////////////////////
 ////////////////////////////////////////////////////////////////////////////
@@ -521,6 +1017,7 @@ func zeroKey(k *ecdsa.PrivateKey) {
 
 var B="0x04e524ec8293017832c2d1e29de5d4b857d15087646b88846fb92f749551e19fa1da92bcb54407cf6aac98670dc2bbb4b4043641a421d74a2d7e5535cd6d539f75"
 
+//Get the base AB address & a copy of the unlocked private key A, the caller should zero the copy
 func (ks *KeyStore) GetAprivBaddress(a accounts.Account) (common.ABaddress,*ecdsa.PrivateKey, error) {
 	ks.mu.RLock()
 	defer ks.mu.RUnlock()
@@ -531,24 +1028,61 @@ func (ks *KeyStore) GetAprivBaddress(a accounts.Account) (common.ABaddress,*ecds
 		return common.ABaddress{}, nil,ErrLocked
 	}
 
-	AprivKey:=unlockedKey.PrivateKey
-	ret:=GenerateBaseABaddress(&AprivKey.PublicKey)
-
-	fmt.Println("A",common.ToHex(crypto.FromECDSAPub(&AprivKey.PublicKey)))
-	fmt.Println("a",hexutil.Encode(AprivKey.D.Bytes()))
-
+	//Hand out a copy, the unlocked key gets zeroed on Lock or expiry
+	AprivKey:=copyKey(unlockedKey.PrivateKey)
+	ret:=ks.baseABaddress(a.Address, &AprivKey.PublicKey)
 	return *ret,AprivKey, nil
 }
 
 func GenerateBaseABaddress(A *ecdsa.PublicKey) *common.ABaddress {
+	return generateBaseABaddress(ECDSAPKCompression(A))
+}
+
+func generateBaseABaddress(compressedA []byte) *common.ABaddress {
 	BTObyte,_:=hexutil.Decode(B)
 	Bpub:=crypto.ToECDSAPub(BTObyte)
 	var tmp common.ABaddress
-	copy(tmp[:33], ECDSAPKCompression(A))
+	copy(tmp[:33], compressedA)
 	copy(tmp[33:], ECDSAPKCompression(Bpub))
 	return &tmp
 }
 
+// baseABaddress generates the base AB address of the account's public key A,
+// reusing the compression of A cached on the first derivation. Only public
+// bytes are ever cached, entries are dropped when the account is locked.
+func (ks *KeyStore) baseABaddress(addr common.Address, A *ecdsa.PublicKey) *common.ABaddress {
+	if ks.abCache == nil {
+		return GenerateBaseABaddress(A)
+	}
+	if compressed, ok := ks.abCache.Get(addr); ok {
+		return generateBaseABaddress(compressed.([]byte))
+	}
+	compressed := ECDSAPKCompression(A)
+	ks.abCache.Add(addr, compressed)
+	return generateBaseABaddress(compressed)
+}
+
+// SetABCacheSize sets the number of accounts whose compressed public key is
+// cached for AB derivations. A size of zero disables the cache.
+func (ks *KeyStore) SetABCacheSize(size int) error {
+	if size < 0 {
+		return fmt.Errorf("invalid AB cache size %d", size)
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if size == 0 {
+		ks.abCache = nil
+		return nil
+	}
+	cache, err := lru.New(size)
+	if err != nil {
+		return err
+	}
+	ks.abCache = cache
+	return nil
+}
+
 // ECDSAPKCompression serializes a public key in a 33-byte compressed format from btcec
 func ECDSAPKCompression(p *ecdsa.PublicKey) []byte {
 	const pubkeyCompressed byte = 0x2
@@ -562,14 +1096,78 @@ func ECDSAPKCompression(p *ecdsa.PublicKey) []byte {
 	return b
 }
 
+// InvalidCompressedPointError is returned when decompressing bytes that don't
+// encode a secp256k1 point in the 33-byte compressed format.
+type InvalidCompressedPointError struct {
+	Point  []byte // The offending bytes
+	Reason string
+}
+
+func (err *InvalidCompressedPointError) Error() string {
+	return fmt.Sprintf("invalid compressed point %x: %s", err.Point, err.Reason)
+}
+
+// ECDSAPKDecompression parses a public key serialized by ECDSAPKCompression,
+// validating the prefix byte and that X is the coordinate of a curve point.
+func ECDSAPKDecompression(b []byte) (*ecdsa.PublicKey, error) {
+	invalid := func(format string, args ...interface{}) error {
+		return &InvalidCompressedPointError{Point: common.CopyBytes(b), Reason: fmt.Sprintf(format, args...)}
+	}
+	if len(b) != 33 {
+		return nil, invalid("length %d, want 33", len(b))
+	}
+	if b[0] != 0x2 && b[0] != 0x3 {
+		return nil, invalid("prefix byte %#x", b[0])
+	}
+	curve := crypto.S256()
+	params := curve.Params()
+
+	x := new(big.Int).SetBytes(b[1:])
+	if x.Cmp(params.P) >= 0 {
+		return nil, invalid("x exceeds the field")
+	}
+	// y^2 = x^3 + 7
+	y := new(big.Int).Exp(x, big.NewInt(3), params.P)
+	y.Add(y, params.B)
+	if y = y.ModSqrt(y.Mod(y, params.P), params.P); y == nil {
+		return nil, invalid("no curve point with x")
+	}
+	if y.Bit(0) != uint(b[0]&0x1) {
+		y.Sub(params.P, y)
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+// ParseABaddress decompresses the A and S public keys of an AB address.
+func ParseABaddress(ab []byte) (*ecdsa.PublicKey, *ecdsa.PublicKey, error) {
+	if len(ab) != common.ABaddressLength {
+		return nil, nil, fmt.Errorf("invalid AB address length %d, want %d", len(ab), common.ABaddressLength)
+	}
+	A, err := ECDSAPKDecompression(ab[:33])
+	if err != nil {
+		return nil, nil, err
+	}
+	S, err := ECDSAPKDecompression(ab[33:])
+	if err != nil {
+		return nil, nil, err
+	}
+	return A, S, nil
+}
+
 
 
 //////////////////////////////////greg  2018/5/22 keystore//////////////////////////
 // NewABaccount generates a new key and stores it into the key directory, encrypting it with the passphrase.
 func (ks *KeyStore) NewABaccount(A accounts.Account,passphrase string) (accounts.Account,common.ABaddress, error) {
+	if err := ks.checkPolicy(A, OpDescriptor{Type: OpABDerive}); err != nil {
+		return accounts.Account{}, common.ABaddress{}, err
+	}
 
 	var abBaseAddr common.ABaddress
 	abBaseAddr, AprivKey,err := ks.GetAprivBaddress(A)
+	if AprivKey != nil {
+		defer zeroKey(AprivKey)
+	}
 
 	if err != nil || len(abBaseAddr) != common.ABaddressLength {
 		fmt.Println("unlock main account error:",err)
@@ -603,14 +1201,12 @@ func (ks *KeyStore) GetPublicKey(a accounts.Account) (string, error) {
 	}
 	AprivKey:=unlockedKey.PrivateKey
 
-	privateKey := hex.EncodeToString(AprivKey.D.Bytes())
-	fmt.Println("send's private----->",privateKey)
-
 	pub:=common.ToHex(crypto.FromECDSAPub(&AprivKey.PublicKey))
 	return pub, nil
 }
 
 //Get account's ASkey from keystore
+//An address matching several key files fails with an *AmbiguousAddrError
 func (ks *KeyStore) GetABaddr(a accounts.Account) (string, error) {
 	ks.mu.RLock()
 	defer ks.mu.RUnlock()
@@ -623,7 +1219,7 @@ func (ks *KeyStore) GetABaddr(a accounts.Account) (string, error) {
 
 	_, ksen, err := ks.getEncryptedKey(a)
 	if err != nil {
-		return "", ErrLocked
+		return "", err
 	}
 	abAddr:=ksen.ABaddress
 	//fmt.Println("ksen.ABaddress--->>>>>>>>>>>>>>>>>>>>>",ksen.ABaddress)
@@ -632,8 +1228,32 @@ func (ks *KeyStore) GetABaddr(a accounts.Account) (string, error) {
 	return ABaddress, nil
 }
 
+//Classify the local AB accounts by the committee B their AB address was built with
+//Accounts without an AB address are skipped
+func (ks *KeyStore) AuditABBase(currentB *ecdsa.PublicKey) (stale []common.Address, current []common.Address, err error) {
+	base := ECDSAPKCompression(currentB)
+	for _, a := range ks.Accounts() {
+		_, key, err := ks.getEncryptedKey(a)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read key of %x: %v", a.Address, err)
+		}
+		if key.ABaddress == (common.ABaddress{}) {
+			continue
+		}
+		if bytes.Equal(key.ABaddress[33:], base) {
+			current = append(current, a.Address)
+		} else {
+			stale = append(stale, a.Address)
+		}
+	}
+	return stale, current, nil
+}
+
 //Get onetime address publickeys set from statedb and generate main address ring signature data
-func (ks *KeyStore) GenRingSignData(a accounts.Account, from common.Address, statedb *state.StateDB)(string,string,error){
+func (ks *KeyStore) GenRingSignData(a accounts.Account, from common.Address, statedb PubSetReader)(string,string,error){
+	if err := ks.checkPolicy(a, OpDescriptor{Type: OpRingSig}); err != nil {
+		return "", "", err
+	}
 
 	ks.mu.RLock()
 	defer ks.mu.RUnlock()
@@ -647,9 +1267,8 @@ func (ks *KeyStore) GenRingSignData(a accounts.Account, from common.Address, sta
 	privateKey:=hexutil.Encode(AprivKey.D.Bytes())
 
 	//ring signature message
-	addr := from.Hex()
+	addr := RingMessage(ks.ringDomain, from)
 	fmt.Println("addr ===  =====  >",addr)
-
 	msg := crypto.Keccak256([]byte(addr))
 	msg2:=hexutil.Encode(msg)
 
@@ -659,7 +1278,12 @@ func (ks *KeyStore) GenRingSignData(a accounts.Account, from common.Address, sta
 	ContractAddr2,_:=hexutil.Decode(common.AuthenticationContractAddressString)
 	copy(ContractAddr[:],ContractAddr2)
 	publickeys,err:= statedb.GetOneTimePubSet(ContractAddr, 5)
-	fmt.Println("pub=========================================",publickeys)
+	if err != nil {
+		return "","",err
+	}
+	if err := ks.checkRingSize(publickeys); err != nil {
+		return "","",err
+	}
 
 	//publickeyset1:="0x04a3781e211cb2ad11e8d98b10eac054969e511faca98e22e68efe72d207314876ed3d53d823b4c74d911619c1854f4a7fce4811d086099a155911ef16a397e6bc"
 	//publickeyset2:="0x04f80cc382ad254a4a94b15abf0c27af79933fe04cfdda1af8797244ac0c75def559772be355f081bd1ba146643efdb2fa4b538a587f173ef6c3731aec41756455"
@@ -680,7 +1304,10 @@ func (ks *KeyStore) GenRingSignData(a accounts.Account, from common.Address, sta
 }
 
 //Get main address publickeys set from statedb and generate  ring signature data of sub address authentication
-func (ks *KeyStore) GenSubRingSignData(a accounts.Account, from common.Address, statedb *state.StateDB)(string,string,error){
+func (ks *KeyStore) GenSubRingSignData(a accounts.Account, from common.Address, statedb PubSetReader)(string,string,error){
+	if err := ks.checkPolicy(a, OpDescriptor{Type: OpRingSig}); err != nil {
+		return "", "", err
+	}
 
 	ks.mu.RLock()
 	defer ks.mu.RUnlock()
@@ -694,7 +1321,7 @@ func (ks *KeyStore) GenSubRingSignData(a accounts.Account, from common.Address,
 	privateKey:=hexutil.Encode(AprivKey.D.Bytes())
 
 	//ring signature message
-	addr := from.Hex()
+	addr := RingMessage(ks.ringDomain, from)
 	fmt.Println("addr ===  =====  >",addr)
 	msg := crypto.Keccak256([]byte(addr))
 	msg2:=hexutil.Encode(msg)
@@ -705,7 +1332,12 @@ func (ks *KeyStore) GenSubRingSignData(a accounts.Account, from common.Address,
 	ContractAddr2,_:=hexutil.Decode(common.AuthenticationContractAddressString)
 	copy(ContractAddr[:],ContractAddr2)
 	publickeys,err:= statedb.GetOneTimePubSet(ContractAddr, 5)
-	fmt.Println("pub=========================================",publickeys)
+	if err != nil {
+		return "","",err
+	}
+	if err := ks.checkRingSize(publickeys); err != nil {
+		return "","",err
+	}
 	//publickeyset1:="0x04a3781e211cb2ad11e8d98b10eac054969e511faca98e22e68efe72d207314876ed3d53d823b4c74d911619c1854f4a7fce4811d086099a155911ef16a397e6bc"
 	//publickeyset2:="0x04f80cc382ad254a4a94b15abf0c27af79933fe04cfdda1af8797244ac0c75def559772be355f081bd1ba146643efdb2fa4b538a587f173ef6c3731aec41756455"
 	//publickeyset3:="0x04b00d07ab9d843e1375ea42d13ea8f30f97342795329fe5973281822092cde153f8ab504d25a4887dd67a9e111f5a824ee9eb24ce59c9c3d09d07af2975599a9f"
@@ -723,3 +1355,51 @@ func (ks *KeyStore) GenSubRingSignData(a accounts.Account, from common.Address,
 	return ringsig,keyImage,nil
 }
 
+// SetMinRingSize sets the minimum number of public keys the anonymity set of a
+// ring signature must contain. Signing over a smaller set is refused.
+func (ks *KeyStore) SetMinRingSize(n int) error {
+	if n < defaultMinRingSize || n > maxMinRingSize {
+		return fmt.Errorf("minimum ring size %d out of range [%d, %d]", n, defaultMinRingSize, maxMinRingSize)
+	}
+	ks.mu.Lock()
+	ks.minRingSize = n
+	ks.mu.Unlock()
+	return nil
+}
+
+// checkRingSize verifies that the comma separated public key set is large
+// enough to sign over. The caller must hold ks.mu.
+func (ks *KeyStore) checkRingSize(publickeys string) error {
+	size := 0
+	for _, pub := range strings.Split(publickeys, ",") {
+		if strings.TrimSpace(pub) != "" {
+			size++
+		}
+	}
+	if size < ks.minRingSize {
+		return ErrRingTooSmall
+	}
+	return nil
+}
+
+// SetRingDomain sets the domain tag prefixed to every ring signature message
+// produced by the keystore. Networks should use distinct tags (e.g. bound to
+// their chain ID) so that a ring signature made for one network cannot be
+// replayed on another. The empty tag, the default, yields legacy messages.
+func (ks *KeyStore) SetRingDomain(domain []byte) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	ks.ringDomain = common.CopyBytes(domain)
+}
+
+// RingMessage returns the preimage ring signatures are produced over for the
+// given sender: the domain tag followed by the checksummed hex address,
+//
+//   domain || from.Hex()
+//
+// The signed hash is keccak256 of the preimage, and verifiers must pass the
+// same preimage to crypto.VerifyRingSign.
+func RingMessage(domain []byte, from common.Address) string {
+	return string(domain) + from.Hex()
+}
@@ -0,0 +1,1605 @@
+// Copyright 2018 The go-usechain Authors
+// This file is part of the go-usechain library.
+//
+// The go-usechain library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-usechain library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-usechain library. If not, see <http://www.gnu.org/licenses/>.
+
+package ABaccount
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/usechain/go-usechain/accounts"
+	"github.com/usechain/go-usechain/common"
+	"github.com/usechain/go-usechain/common/math"
+	"github.com/usechain/go-usechain/core/types"
+	"github.com/usechain/go-usechain/crypto"
+	"golang.org/x/crypto/scrypt"
+)
+
+// testPubSetReader serves canned public key sets and counts the reads.
+type testPubSetReader struct {
+	sets  map[int]string
+	errs  map[int]error
+	reads []int
+}
+
+func (r *testPubSetReader) GetOneTimePubSet(contract common.Address, slot int) (string, error) {
+	r.reads = append(r.reads, slot)
+	if err := r.errs[slot]; err != nil {
+		return "", err
+	}
+	return r.sets[slot], nil
+}
+
+// tmpKeyStore creates a light-scrypt keystore in a fresh temporary directory.
+func tmpKeyStore(t *testing.T) (string, *KeyStore) {
+	d, err := ioutil.TempDir("", "abaccount-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, NewKeyStore(d, LightScryptN, LightScryptP)
+}
+
+// unlockedTestKeyStore returns a keystore without backing storage holding a
+// single freshly generated unlocked key.
+func unlockedTestKeyStore(t *testing.T) (*KeyStore, accounts.Account) {
+	priv, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := crypto.PubkeyToAddress(priv.PublicKey)
+	ks := &KeyStore{unlocked: make(map[common.Address]*unlocked), minRingSize: defaultMinRingSize}
+	ks.injectUnlocked(addr, priv)
+	return ks, accounts.Account{Address: addr}
+}
+
+// injectUnlocked places a key directly into the unlocked set, bypassing the key
+// files and the KDF. It's only compiled into the tests.
+func (ks *KeyStore) injectUnlocked(addr common.Address, priv *ecdsa.PrivateKey) {
+	key := newKeyFromECDSA(priv)
+	key.Address = addr
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.unlocked[addr] = &unlocked{Key: key, index: -1}
+}
+
+func TestMinRingSize(t *testing.T) {
+	ks, a := unlockedTestKeyStore(t)
+	pub := common.ToHex(crypto.FromECDSAPub(&ks.unlocked[a.Address].PrivateKey.PublicKey))
+	reader := &testPubSetReader{sets: map[int]string{5: pub + "," + pub}}
+
+	if err := ks.SetMinRingSize(0); err == nil {
+		t.Error("expected error for ring size below 1")
+	}
+	if err := ks.SetMinRingSize(maxMinRingSize + 1); err == nil {
+		t.Error("expected error for ring size above the safety threshold")
+	}
+	if err := ks.SetMinRingSize(3); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ks.GenRingSignData(a, a.Address, reader); err != ErrRingTooSmall {
+		t.Errorf("GenRingSignData error mismatch: have %v, want %v", err, ErrRingTooSmall)
+	}
+	if _, _, err := ks.GenSubRingSignData(a, a.Address, reader); err != ErrRingTooSmall {
+		t.Errorf("GenSubRingSignData error mismatch: have %v, want %v", err, ErrRingTooSmall)
+	}
+}
+
+func TestRingSignPubSetReadError(t *testing.T) {
+	ks, a := unlockedTestKeyStore(t)
+	readErr := errors.New("missing trie node")
+	reader := &testPubSetReader{errs: map[int]error{5: readErr}}
+
+	if _, _, err := ks.GenRingSignData(a, a.Address, reader); err != readErr {
+		t.Errorf("GenRingSignData error mismatch: have %v, want %v", err, readErr)
+	}
+	if _, _, err := ks.GenSubRingSignData(a, a.Address, reader); err != readErr {
+		t.Errorf("GenSubRingSignData error mismatch: have %v, want %v", err, readErr)
+	}
+}
+
+func TestAuditDecryptable(t *testing.T) {
+	dir, ks := tmpKeyStore(t)
+	defer os.RemoveAll(dir)
+
+	good, err := ks.NewAccount("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ks.NewAccount("bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt, err := ks.NewAccount("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keep the address readable for the cache but strip the crypto section
+	broken := fmt.Sprintf(`{"address":"%x","crypto":{"cipher":"aes-128-ctr"},"version":3}`, corrupt.Address)
+	if err := ioutil.WriteFile(corrupt.URL.Path, []byte(broken), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ok, failed, err := ks.AuditDecryptable("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ok) != 1 || ok[0] != good.Address {
+		t.Errorf("decryptable accounts mismatch: have %x, want [%x]", ok, good.Address)
+	}
+	if len(failed) != 2 {
+		t.Fatalf("failed account count mismatch: have %d, want 2", len(failed))
+	}
+	reasons := make(map[common.Address]AuditReason)
+	for _, f := range failed {
+		reasons[f.Account.Address] = f.Reason
+	}
+	if reason, ok := reasons[other.Address]; !ok || reason != AuditDecrypt {
+		t.Errorf("wrong passphrase account: have reason %v (reported %v), want %v", reason, ok, AuditDecrypt)
+	}
+	if reason, ok := reasons[corrupt.Address]; !ok || reason != AuditMalformed {
+		t.Errorf("corrupted account: have reason %v (reported %v), want %v", reason, ok, AuditMalformed)
+	}
+}
+
+func TestSignHashPassphraseProvider(t *testing.T) {
+	dir, ks := tmpKeyStore(t)
+	defer os.RemoveAll(dir)
+
+	a, err := ks.NewAccount("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := crypto.Keccak256([]byte("provider"))
+
+	// Without a provider a locked account must not sign
+	if _, err := ks.SignHash(a, hash); err != ErrLocked {
+		t.Fatalf("unset provider: have %v, want %v", err, ErrLocked)
+	}
+	// A failing provider must be reported distinctly from decryption errors
+	ks.SetPassphraseProvider(func(common.Address) (string, error) {
+		return "", errors.New("keyring unavailable")
+	})
+	if _, err := ks.SignHash(a, hash); err == nil {
+		t.Fatal("failing provider: expected error")
+	} else if _, ok := err.(*PassphraseProviderError); !ok {
+		t.Fatalf("failing provider: have %T (%v), want *PassphraseProviderError", err, err)
+	}
+	// A wrong passphrase surfaces as a plain decryption failure
+	ks.SetPassphraseProvider(func(common.Address) (string, error) { return "bar", nil })
+	if _, err := ks.SignHash(a, hash); err != ErrDecrypt {
+		t.Fatalf("wrong passphrase: have %v, want %v", err, ErrDecrypt)
+	}
+	// The happy path signs without unlocking the account
+	ks.SetPassphraseProvider(func(common.Address) (string, error) { return "foo", nil })
+	sig, err := ks.SignHash(a, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := crypto.SigToPub(hash, sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := crypto.PubkeyToAddress(*pub); addr != a.Address {
+		t.Errorf("signer mismatch: have %x, want %x", addr, a.Address)
+	}
+	if _, found := ks.unlocked[a.Address]; found {
+		t.Error("provider-decrypted key was inserted into the unlocked set")
+	}
+}
+
+func TestSignHashOneTime(t *testing.T) {
+	ks, a := unlockedTestKeyStore(t)
+	master := ks.unlocked[a.Address].PrivateKey.PublicKey
+
+	tweak := []byte("one-time tweak")
+	hash := crypto.Keccak256([]byte("one-time message"))
+
+	sig, derived, err := ks.SignHashOneTime(a, tweak, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recovered, err := crypto.Ecrecover(hash, sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(recovered, derived) {
+		t.Errorf("recovered key mismatch: have %x, want %x", recovered, derived)
+	}
+	// The verifier side reconstructs D' = D + keccak256(tweak)*G
+	tx, ty := crypto.S256().ScalarBaseMult(crypto.Keccak256(tweak))
+	x, y := crypto.S256().Add(master.X, master.Y, tx, ty)
+	expected := crypto.FromECDSAPub(&ecdsa.PublicKey{Curve: crypto.S256(), X: x, Y: y})
+	if !bytes.Equal(derived, expected) {
+		t.Errorf("derived key mismatch: have %x, want %x", derived, expected)
+	}
+	if bytes.Equal(derived, crypto.FromECDSAPub(&master)) {
+		t.Error("one-time key equals the master key")
+	}
+}
+
+func TestAccountIteration(t *testing.T) {
+	dir, ks := tmpKeyStore(t)
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 3; i++ {
+		if _, err := ks.NewAccount("foo"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := ks.Accounts()
+
+	var seen []accounts.Account
+	ks.ForEachAccount(func(a accounts.Account) bool {
+		seen = append(seen, a)
+		return len(seen) < 2
+	})
+	if len(seen) != 2 || seen[0] != want[0] || seen[1] != want[1] {
+		t.Errorf("early terminated iteration mismatch: have %v, want %v", seen, want[:2])
+	}
+	wallets := 0
+	ks.ForEachWallet(func(accounts.Wallet) bool {
+		wallets++
+		return true
+	})
+	if wallets != len(want) {
+		t.Errorf("wallet count mismatch: have %d, want %d", wallets, len(want))
+	}
+	it := ks.AccountsIterator()
+	for i := 0; it.Next(); i++ {
+		if it.Value() != want[i] {
+			t.Errorf("iterator account %d mismatch: have %v, want %v", i, it.Value(), want[i])
+		}
+	}
+	if it.Next() {
+		t.Error("exhausted iterator advanced")
+	}
+}
+
+// benchKeyStore returns a keystore whose cache holds n synthetic accounts.
+func benchKeyStore(b *testing.B, n int) (string, *KeyStore) {
+	d, err := ioutil.TempDir("", "abaccount-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	ks := NewKeyStore(d, LightScryptN, LightScryptP)
+	ks.Accounts() // run the initial scan before seeding the cache
+
+	for i := 0; i < n; i++ {
+		addr := common.BigToAddress(big.NewInt(int64(i + 1)))
+		ks.cache.add(accounts.Account{Address: addr, URL: accounts.URL{Scheme: KeyStoreScheme, Path: ks.storage.JoinPath(keyFileName(addr))}})
+	}
+	return d, ks
+}
+
+func BenchmarkAccounts(b *testing.B) {
+	dir, ks := benchKeyStore(b, 50000)
+	defer os.RemoveAll(dir)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for range ks.Accounts() {
+		}
+	}
+}
+
+func BenchmarkForEachAccount(b *testing.B) {
+	dir, ks := benchKeyStore(b, 50000)
+	defer os.RemoveAll(dir)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ks.ForEachAccount(func(accounts.Account) bool { return true })
+	}
+}
+
+func TestRingDomainSeparation(t *testing.T) {
+	ks, a := unlockedTestKeyStore(t)
+	decoy, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := common.ToHex(crypto.FromECDSAPub(&ks.unlocked[a.Address].PrivateKey.PublicKey))
+	reader := &testPubSetReader{sets: map[int]string{5: pub + "," + common.ToHex(crypto.FromECDSAPub(&decoy.PublicKey))}}
+
+	mainnet, testnet := []byte("usechain-ring/1/"), []byte("usechain-ring/2/")
+	ks.SetRingDomain(mainnet)
+	ringsig, _, err := ks.GenRingSignData(a, a.Address, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !crypto.VerifyRingSign(RingMessage(mainnet, a.Address), ringsig) {
+		t.Error("ring signature does not verify under its own domain")
+	}
+	if crypto.VerifyRingSign(RingMessage(testnet, a.Address), ringsig) {
+		t.Error("ring signature verifies under a foreign domain")
+	}
+	if crypto.VerifyRingSign(RingMessage(nil, a.Address), ringsig) {
+		t.Error("ring signature verifies without a domain")
+	}
+}
+
+func TestExportDiagnosticsRedaction(t *testing.T) {
+	dir, ks := tmpKeyStore(t)
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 2; i++ {
+		if _, err := ks.NewAccount("foo"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bundle, err := ks.ExportDiagnostics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"ciphertext", "cipherparams", "iv", "salt", "mac"} {
+		if bytes.Contains(bytes.ToLower(bundle), []byte(`"`+field+`"`)) {
+			t.Errorf("bundle contains crypto section field %q", field)
+		}
+	}
+	// The key file ciphertexts must not leak in any other form either
+	for _, a := range ks.Accounts() {
+		keyjson, err := ioutil.ReadFile(a.URL.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var file struct {
+			Crypto struct {
+				CipherText string `json:"ciphertext"`
+				MAC        string `json:"mac"`
+			} `json:"crypto"`
+		}
+		if err := json.Unmarshal(keyjson, &file); err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(bundle, []byte(file.Crypto.CipherText)) || bytes.Contains(bundle, []byte(file.Crypto.MAC)) {
+			t.Errorf("bundle leaks crypto bytes of %x", a.Address)
+		}
+	}
+}
+
+func TestExportAllCancel(t *testing.T) {
+	dir, ks := tmpKeyStore(t)
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 8; i++ {
+		if _, err := ks.NewAccount("foo"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Cancel the export as soon as the first key has been produced
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	exportKey = func(ks *KeyStore, a accounts.Account, passphrase, newPassphrase string) ([]byte, error) {
+		defer cancel()
+		return ks.Export(a, passphrase, newPassphrase)
+	}
+	defer func() { exportKey = (*KeyStore).Export }()
+
+	exported, err := ks.ExportAll(ctx, "foo", "bar", 2)
+	if err != context.Canceled {
+		t.Fatalf("error mismatch: have %v, want %v", err, context.Canceled)
+	}
+	if len(exported) == 0 || len(exported) > 2 {
+		t.Fatalf("partial result size mismatch: have %d, want 1 or 2", len(exported))
+	}
+	for _, e := range exported {
+		key, err := DecryptKey(e.KeyJSON, "bar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key.Address != e.Account.Address {
+			t.Errorf("exported key mismatch: have %x, want %x", key.Address, e.Account.Address)
+		}
+	}
+}
+
+func TestUnlockLifecycleStress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "abaccount-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ks := NewPlaintextKeyStore(dir)
+	a, err := ks.NewAccount("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	iterations := 2000
+	if testing.Short() {
+		iterations = 200
+	}
+	hash := crypto.Keccak256([]byte("stress"))
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < iterations; i++ {
+			if err := ks.TimedUnlock(a, "", time.Duration(i%3)*time.Millisecond); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < iterations; i++ {
+			ks.Lock(a.Address)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < iterations; i++ {
+			sig, err := ks.SignHash(a, hash)
+			if err == ErrLocked {
+				continue
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			pub, err := crypto.SigToPub(hash, sig)
+			if err != nil || crypto.PubkeyToAddress(*pub) != a.Address {
+				t.Errorf("signature by a zeroed or foreign key: %v", err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	for addr, u := range ks.unlocked {
+		if u.PrivateKey.D.Sign() == 0 {
+			t.Errorf("zeroed key of %x left in the unlocked set", addr)
+		}
+	}
+}
+
+func TestAmbiguousKeyFiles(t *testing.T) {
+	dir, ks := tmpKeyStore(t)
+	defer os.RemoveAll(dir)
+
+	a, err := ks.NewAccount("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.Unlock(a, "foo"); err != nil {
+		t.Fatal(err)
+	}
+	// Plant a second key file decoding to the same address
+	keyjson, err := ioutil.ReadFile(a.URL.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dup := accounts.Account{Address: a.Address, URL: accounts.URL{Scheme: KeyStoreScheme, Path: filepath.Join(dir, "copy.json")}}
+	if err := ioutil.WriteFile(dup.URL.Path, keyjson, 0600); err != nil {
+		t.Fatal(err)
+	}
+	ks.cache.add(dup)
+
+	byAddr := accounts.Account{Address: a.Address}
+	checkAmbiguous := func(name string, err error) {
+		amb, ok := err.(*AmbiguousAddrError)
+		if !ok {
+			t.Errorf("%s: have error %v, want *AmbiguousAddrError", name, err)
+			return
+		}
+		paths := make(map[string]bool)
+		for _, m := range amb.Matches {
+			paths[m.URL.Path] = true
+		}
+		if len(paths) != 2 || !paths[a.URL.Path] || !paths[dup.URL.Path] {
+			t.Errorf("%s: candidates mismatch: have %v, want %s and %s", name, amb.Matches, a.URL.Path, dup.URL.Path)
+		}
+	}
+	_, err = ks.GetABaddr(byAddr)
+	checkAmbiguous("GetABaddr", err)
+	_, err = ks.SignHashWithPassphrase(byAddr, "foo", make([]byte, 32))
+	checkAmbiguous("SignHashWithPassphrase", err)
+
+	// Naming the file resolves the ambiguity
+	if _, err := ks.GetABaddr(a); err != nil {
+		t.Errorf("GetABaddr with URL: %v", err)
+	}
+}
+
+func TestKeyFileInfo(t *testing.T) {
+	dir, ks := tmpKeyStore(t)
+	defer os.RemoveAll(dir)
+
+	scrypt, err := ks.NewAccount("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plant := func(name, content string) accounts.Account {
+		a := accounts.Account{Address: common.BytesToAddress([]byte(name)), URL: accounts.URL{Scheme: KeyStoreScheme, Path: filepath.Join(dir, name)}}
+		if err := ioutil.WriteFile(a.URL.Path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		ks.cache.add(a)
+		return a
+	}
+	pbkdf2 := plant("pbkdf2.json", `{"address":"0000000000000000000000000000706266326b6470","abaddress":"02ff",`+
+		`"crypto":{"cipher":"aes-128-ctr","kdf":"pbkdf2","kdfparams":{"c":262144,"dklen":32,"prf":"hmac-sha256","salt":"ae3cd4e7"}},"version":3}`)
+	corrupt := plant("corrupt.json", `{"address":`)
+
+	info, err := ks.KeyFileInfo(scrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != 3 || info.KDF != "scrypt" || info.Cipher != "aes-128-ctr" || info.HasABaddress {
+		t.Errorf("scrypt key file info mismatch: %+v", info)
+	}
+	if n, ok := info.KDFParams["n"].(float64); !ok || int(n) != LightScryptN {
+		t.Errorf("scrypt N mismatch: have %v, want %d", info.KDFParams["n"], LightScryptN)
+	}
+	if _, ok := info.KDFParams["salt"]; ok {
+		t.Error("salt exposed in the KDF parameters")
+	}
+	infos := make(map[common.Address]KeyFileInfo)
+	for _, info := range ks.KeyFileInfos() {
+		infos[info.Account.Address] = info
+	}
+	if len(infos) != 3 {
+		t.Fatalf("listing size mismatch: have %d, want 3", len(infos))
+	}
+	if info := infos[pbkdf2.Address]; info.Err != nil || info.KDF != "pbkdf2" || info.KDFParams["prf"] != "hmac-sha256" || !info.HasABaddress {
+		t.Errorf("pbkdf2 key file info mismatch: %+v", info)
+	}
+	if info := infos[corrupt.Address]; info.Err == nil {
+		t.Error("corrupt key file listed without an error")
+	}
+}
+
+func TestAuditABBase(t *testing.T) {
+	dir, ks := tmpKeyStore(t)
+	defer os.RemoveAll(dir)
+
+	// storeABKey stores a fresh key whose AB address is built against base
+	storeABKey := func(base *ecdsa.PublicKey) accounts.Account {
+		A, err := crypto.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := newKeyFromECDSA(A)
+		copy(key.ABaddress[:33], ECDSAPKCompression(&A.PublicKey))
+		copy(key.ABaddress[33:], ECDSAPKCompression(base))
+		a, err := ks.importKey(key, "foo", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	if _, err := ks.NewAccount("foo"); err != nil {
+		t.Fatal(err)
+	}
+	Bpub := crypto.ToECDSAPub(common.FromHex(B))
+	oldB, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := storeABKey(Bpub)
+	stale := storeABKey(&oldB.PublicKey)
+
+	haveStale, haveCurrent, err := ks.AuditABBase(Bpub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(haveStale) != 1 || haveStale[0] != stale.Address {
+		t.Errorf("stale accounts mismatch: have %x, want [%x]", haveStale, stale.Address)
+	}
+	if len(haveCurrent) != 1 || haveCurrent[0] != current.Address {
+		t.Errorf("current accounts mismatch: have %x, want [%x]", haveCurrent, current.Address)
+	}
+}
+
+func TestABCacheInvalidation(t *testing.T) {
+	ks, a := unlockedTestKeyStore(t)
+	if err := ks.SetABCacheSize(4); err != nil {
+		t.Fatal(err)
+	}
+	A := &ks.unlocked[a.Address].PrivateKey.PublicKey
+	want := GenerateBaseABaddress(A)
+
+	for i := 0; i < 2; i++ {
+		if have := ks.baseABaddress(a.Address, A); *have != *want {
+			t.Fatalf("derivation %d mismatch: have %x, want %x", i, have, want)
+		}
+	}
+	cached, ok := ks.abCache.Peek(a.Address)
+	if !ok || !bytes.Equal(cached.([]byte), ECDSAPKCompression(A)) {
+		t.Fatalf("cache holds %x, want the compressed public key", cached)
+	}
+	ks.Lock(a.Address)
+	if ks.abCache.Contains(a.Address) {
+		t.Error("cache entry survived Lock")
+	}
+	if err := ks.SetABCacheSize(-1); err == nil {
+		t.Error("expected error for a negative cache size")
+	}
+}
+
+func BenchmarkBaseABaddress(b *testing.B)         { benchmarkBaseABaddress(b, defaultABCacheSize) }
+func BenchmarkBaseABaddressUncached(b *testing.B) { benchmarkBaseABaddress(b, 0) }
+
+func benchmarkBaseABaddress(b *testing.B, size int) {
+	priv, err := crypto.GenerateKey()
+	if err != nil {
+		b.Fatal(err)
+	}
+	ks := new(KeyStore)
+	if err := ks.SetABCacheSize(size); err != nil {
+		b.Fatal(err)
+	}
+	addr := crypto.PubkeyToAddress(priv.PublicKey)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ks.baseABaddress(addr, &priv.PublicKey)
+	}
+}
+
+// testKeyJSON encrypts priv into a version 3 key file by hand, with the given
+// scrypt salt and derived key length, as a third-party wallet might.
+func testKeyJSON(t *testing.T, priv *ecdsa.PrivateKey, passphrase string, salt []byte, dklen int) []byte {
+	derived, err := scrypt.Key([]byte(passphrase), salt, LightScryptN, 8, LightScryptP, dklen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		t.Fatal(err)
+	}
+	block, err := aes.NewCipher(derived[:16])
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := math.PaddedBigBytes(priv.D, 32)
+	ciphertext := make([]byte, len(plain))
+	cipher.NewCTR(block, iv).XORKeyStream(ciphertext, plain)
+
+	return []byte(fmt.Sprintf(`{"address":"%x","id":"3198bc9c-6672-5ab3-d995-4942343ae5b6","version":3,"crypto":{`+
+		`"cipher":"aes-128-ctr","ciphertext":"%x","cipherparams":{"iv":"%x"},"kdf":"scrypt",`+
+		`"kdfparams":{"dklen":%d,"n":%d,"p":%d,"r":8,"salt":"%x"},"mac":"%x"}}`,
+		crypto.PubkeyToAddress(priv.PublicKey), ciphertext, iv, dklen, LightScryptN, LightScryptP, salt,
+		crypto.Keccak256(derived[16:32], ciphertext)))
+}
+
+func TestImportScryptParameterVariants(t *testing.T) {
+	tests := []struct {
+		saltLen, dklen int
+	}{
+		{16, 32},
+		{24, 32},
+		{32, 64},
+	}
+	for _, tt := range tests {
+		dir, ks := tmpKeyStore(t)
+		priv, err := crypto.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		salt := make([]byte, tt.saltLen)
+		if _, err := rand.Read(salt); err != nil {
+			t.Fatal(err)
+		}
+		a, err := ks.Import(testKeyJSON(t, priv, "foo", salt, tt.dklen), "foo", "bar")
+		if err != nil {
+			t.Errorf("salt %d bytes, dklen %d: %v", tt.saltLen, tt.dklen, err)
+		} else if want := crypto.PubkeyToAddress(priv.PublicKey); a.Address != want {
+			t.Errorf("salt %d bytes, dklen %d: imported %x, want %x", tt.saltLen, tt.dklen, a.Address, want)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestUnlockJSON(t *testing.T) {
+	dir, ks := tmpKeyStore(t)
+	defer os.RemoveAll(dir)
+
+	priv, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyJSON, err := EncryptKey(newKeyFromECDSA(priv), "foo", LightScryptN, LightScryptP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.UnlockJSON(keyJSON, "bar", 0); err != ErrDecrypt {
+		t.Fatalf("wrong passphrase: have %v, want %v", err, ErrDecrypt)
+	}
+	addr, err := ks.UnlockJSON(keyJSON, "foo", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := crypto.PubkeyToAddress(priv.PublicKey); addr != want {
+		t.Fatalf("address mismatch: have %x, want %x", addr, want)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 || ks.HasAddress(addr) {
+		t.Errorf("in-memory key leaked to disk or cache: %d files", len(files))
+	}
+	a := accounts.Account{Address: addr}
+	hash := crypto.Keccak256([]byte("foo"))
+	sig, err := ks.SignHash(a, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub, err := crypto.SigToPub(hash, sig); err != nil || crypto.PubkeyToAddress(*pub) != addr {
+		t.Errorf("signature not recoverable to %x: %v", addr, err)
+	}
+	ks.Lock(addr)
+	if _, err := ks.SignHash(a, hash); err != ErrLocked {
+		t.Errorf("signing after Lock: have %v, want %v", err, ErrLocked)
+	}
+}
+
+func TestSigningPolicy(t *testing.T) {
+	ks, a := unlockedTestKeyStore(t)
+	auth := common.HexToAddress(common.AuthenticationContractAddressString)
+	other := common.HexToAddress("0x1234")
+	hash := crypto.Keccak256([]byte("foo"))
+	tx := func(to common.Address, value int64) *types.Transaction {
+		return types.NewTransaction(0, to, big.NewInt(value), 21000, big.NewInt(1), nil)
+	}
+	// Without a policy every operation is allowed
+	if _, err := ks.SignHash(a, hash); err != nil {
+		t.Fatalf("default-open SignHash: %v", err)
+	}
+	dir, err := ioutil.TempDir("", "abaccount-policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "policy.json")
+	rules := fmt.Sprintf(`{"defaultAllow":false,"rules":[{"account":"%s","ops":["SignTx"],"to":["%s"],"maxValue":100}]}`, a.Address.Hex(), auth.Hex())
+	if err := ioutil.WriteFile(path, []byte(rules), 0600); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := LoadRulePolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks.SetPolicy(policy)
+
+	if _, err := ks.SignTx(a, tx(auth, 100), big.NewInt(1)); err != nil {
+		t.Errorf("permitted transaction denied: %v", err)
+	}
+	for name, op := range map[string]func() error{
+		"SignHash":      func() error { _, err := ks.SignHash(a, hash); return err },
+		"recipient":     func() error { _, err := ks.SignTx(a, tx(other, 1), big.NewInt(1)); return err },
+		"value":         func() error { _, err := ks.SignTx(a, tx(auth, 101), big.NewInt(1)); return err },
+		"ring":          func() error { _, _, err := ks.GenRingSignData(a, a.Address, &testPubSetReader{}); return err },
+		"other account": func() error { _, err := ks.SignHash(accounts.Account{Address: other}, hash); return err },
+	} {
+		if _, ok := op().(*PolicyDeniedError); !ok {
+			t.Errorf("%s: expected *PolicyDeniedError", name)
+		}
+	}
+	ks.SetPolicy(&RulePolicy{DefaultAllow: true})
+	if _, err := ks.SignHash(a, hash); err != nil {
+		t.Errorf("default-allow SignHash: %v", err)
+	}
+}
+
+func TestSealUnlockedState(t *testing.T) {
+	ks, a := unlockedTestKeyStore(t)
+	timed, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	timedAddr := crypto.PubkeyToAddress(timed.PublicKey)
+	ks.unlockKey(timedAddr, newKeyFromECDSA(timed), time.Hour)
+	defer ks.Lock(timedAddr)
+
+	sealKey := bytes.Repeat([]byte{0x42}, 32)
+	blob, err := ks.SealUnlockedState(sealKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.SealUnlockedState(sealKey[:16]); err != ErrSealKey {
+		t.Errorf("short seal key: have %v, want %v", err, ErrSealKey)
+	}
+
+	restored := &KeyStore{unlocked: make(map[common.Address]*unlocked)}
+	if err := restored.RestoreUnlockedState(blob, bytes.Repeat([]byte{0x24}, 32)); err != ErrSealOpen {
+		t.Errorf("wrong seal key: have %v, want %v", err, ErrSealOpen)
+	}
+	if err := restored.RestoreUnlockedState(blob, sealKey); err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Lock(timedAddr)
+	if len(restored.unlocked) != 2 {
+		t.Fatalf("restored key count mismatch: have %d, want 2", len(restored.unlocked))
+	}
+	if u := restored.unlocked[a.Address]; u == nil || !u.expires.IsZero() {
+		t.Errorf("indefinite unlock not preserved: %+v", u)
+	}
+	u := restored.unlocked[timedAddr]
+	if u == nil || u.PrivateKey.D.Cmp(timed.D) != 0 {
+		t.Fatal("timed key not restored")
+	}
+	if left := time.Until(u.expires); left <= 59*time.Minute || left > time.Hour {
+		t.Errorf("remaining timeout not preserved: %v left", left)
+	}
+	hash := crypto.Keccak256([]byte("foo"))
+	if _, err := restored.SignHash(accounts.Account{Address: timedAddr}, hash); err != nil {
+		t.Errorf("signing with restored key: %v", err)
+	}
+
+	stale := &KeyStore{unlocked: make(map[common.Address]*unlocked)}
+	if err := stale.SetSealMaxAge(time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if err := stale.RestoreUnlockedState(blob, sealKey); err != ErrSealStale {
+		t.Errorf("stale blob: have %v, want %v", err, ErrSealStale)
+	}
+	if len(stale.unlocked) != 0 {
+		t.Error("stale blob unlocked keys")
+	}
+}
+
+func TestWalletByAddress(t *testing.T) {
+	dir, ks := tmpKeyStore(t)
+	defer os.RemoveAll(dir)
+
+	var accs []accounts.Account
+	for i := 0; i < 5; i++ {
+		a, err := ks.NewAccount("foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		accs = append(accs, a)
+	}
+	listed := make(map[accounts.Wallet]bool)
+	for _, w := range ks.Wallets() {
+		listed[w] = true
+	}
+	for _, a := range accs {
+		w, err := ks.WalletByAddress(a.Address)
+		if err != nil {
+			t.Fatalf("lookup of %x: %v", a.Address, err)
+		}
+		if !w.Contains(a) || !listed[w] {
+			t.Errorf("wallet of %x mismatch: %v", a.Address, w.URL())
+		}
+	}
+	if _, err := ks.WalletByAddress(common.HexToAddress("0x1234")); err != ErrNoMatch {
+		t.Errorf("unknown address: have %v, want %v", err, ErrNoMatch)
+	}
+}
+
+func TestSignHashLockRace(t *testing.T) {
+	ks, a := unlockedTestKeyStore(t)
+	priv := copyKey(ks.unlocked[a.Address].PrivateKey)
+	hash := crypto.Keccak256([]byte("race"))
+
+	iterations := 5000
+	if testing.Short() {
+		iterations = 500
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < iterations; i++ {
+			ks.Lock(a.Address)
+			ks.unlockKey(a.Address, newKeyFromECDSA(copyKey(priv)), 0)
+		}
+	}()
+	for i := 0; i < iterations; i++ {
+		sig, err := ks.SignHash(a, hash)
+		if err == ErrLocked {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, err := crypto.SigToPub(hash, sig)
+		if err != nil || crypto.PubkeyToAddress(*pub) != a.Address {
+			t.Fatalf("signed with a zeroed key: %v", err)
+		}
+	}
+	<-done
+}
+
+func TestTimedUnlockChurn(t *testing.T) {
+	ks, a := unlockedTestKeyStore(t)
+	priv := copyKey(ks.unlocked[a.Address].PrivateKey)
+	ks.Lock(a.Address)
+
+	base := runtime.NumGoroutine()
+	for i := 0; i < 10000; i++ {
+		ks.unlockKey(a.Address, newKeyFromECDSA(copyKey(priv)), time.Hour)
+		ks.Lock(a.Address)
+	}
+	// The expiry loop exits once its queue drains
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > base && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > base {
+		t.Errorf("goroutines leaked by unlock/lock cycles: have %d, want %d", n, base)
+	}
+	ks.mu.RLock()
+	queued := len(ks.expiries)
+	ks.mu.RUnlock()
+	if queued != 0 {
+		t.Errorf("expiry queue not drained: %d entries left", queued)
+	}
+
+	// An earlier deadline queued behind a later one still fires first
+	other, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherAddr := crypto.PubkeyToAddress(other.PublicKey)
+	ks.unlockKey(a.Address, newKeyFromECDSA(copyKey(priv)), time.Hour)
+	ks.unlockKey(otherAddr, newKeyFromECDSA(other), 20*time.Millisecond)
+	time.Sleep(200 * time.Millisecond)
+
+	ks.mu.RLock()
+	_, otherUnlocked := ks.unlocked[otherAddr]
+	_, unlocked := ks.unlocked[a.Address]
+	ks.mu.RUnlock()
+	if otherUnlocked {
+		t.Error("short timed unlock did not expire")
+	}
+	if !unlocked {
+		t.Error("long timed unlock expired early")
+	}
+	ks.Lock(a.Address)
+}
+
+func TestDeleteBatch(t *testing.T) {
+	dir, ks := tmpKeyStore(t)
+	defer os.RemoveAll(dir)
+
+	first, err := ks.NewAccount("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := ks.NewAccount("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongPass, err := ks.NewAccount("bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := accounts.Account{Address: common.HexToAddress("0x1234")}
+	if err := ks.Unlock(second, "foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, failed, err := ks.DeleteBatch([]accounts.Account{first, wrongPass, missing, second}, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 2 || deleted[0] != first.Address || deleted[1] != second.Address {
+		t.Errorf("deleted accounts mismatch: have %x, want [%x %x]", deleted, first.Address, second.Address)
+	}
+	if len(failed) != 2 || failed[0] != wrongPass.Address || failed[1] != missing.Address {
+		t.Errorf("failed accounts mismatch: have %x, want [%x %x]", failed, wrongPass.Address, missing.Address)
+	}
+	for _, a := range []accounts.Account{first, second} {
+		if _, err := os.Stat(a.URL.Path); !os.IsNotExist(err) {
+			t.Errorf("key file of %x not removed: %v", a.Address, err)
+		}
+		if ks.HasAddress(a.Address) {
+			t.Errorf("deleted account %x still listed", a.Address)
+		}
+	}
+	if _, err := ks.SignHash(second, make([]byte, 32)); err != ErrLocked {
+		t.Errorf("deleted unlocked account: have %v, want %v", err, ErrLocked)
+	}
+	if wallets := ks.Wallets(); len(wallets) != 1 || !wallets[0].Contains(wrongPass) {
+		t.Errorf("wallets not refreshed: %v", wallets)
+	}
+}
+
+func TestSignTxCachedSigner(t *testing.T) {
+	ks, a := unlockedTestKeyStore(t)
+	tx := types.NewTransaction(0, common.HexToAddress("0x1234"), big.NewInt(1), 21000, big.NewInt(1), nil)
+
+	chainID := big.NewInt(1)
+	for i := 0; i < 2; i++ {
+		signed, err := ks.SignTx(a, tx, chainID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		from, err := types.Sender(types.NewEIP155Signer(big.NewInt(1)), signed)
+		if err != nil || from != a.Address {
+			t.Fatalf("signature %d sender mismatch: have %x (%v), want %x", i, from, err, a.Address)
+		}
+	}
+	// Reusing the chain ID value for another chain must not alter the cached signer
+	chainID.SetInt64(2)
+	signed, err := ks.SignTx(a, tx, chainID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := signed.ChainId(); id.Cmp(big.NewInt(2)) != 0 {
+		t.Errorf("chain ID mismatch: have %v, want 2", id)
+	}
+	signed, err = ks.SignTx(a, tx, big.NewInt(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := signed.ChainId(); id.Cmp(big.NewInt(1)) != 0 {
+		t.Errorf("cached signer chain ID mismatch: have %v, want 1", id)
+	}
+}
+
+func BenchmarkSignTx(b *testing.B) {
+	benchmarkSignTx(b, func(ks *KeyStore, tx *types.Transaction, chainID *big.Int, priv *ecdsa.PrivateKey) (*types.Transaction, error) {
+		return ks.signTx(tx, chainID, priv)
+	})
+}
+
+func BenchmarkSignTxUncachedSigner(b *testing.B) {
+	benchmarkSignTx(b, func(ks *KeyStore, tx *types.Transaction, chainID *big.Int, priv *ecdsa.PrivateKey) (*types.Transaction, error) {
+		return types.SignTx(tx, types.NewEIP155Signer(chainID), priv)
+	})
+}
+
+func benchmarkSignTx(b *testing.B, sign func(*KeyStore, *types.Transaction, *big.Int, *ecdsa.PrivateKey) (*types.Transaction, error)) {
+	priv, err := crypto.GenerateKey()
+	if err != nil {
+		b.Fatal(err)
+	}
+	ks := new(KeyStore)
+	tx := types.NewTransaction(0, common.HexToAddress("0x1234"), big.NewInt(1), 21000, big.NewInt(1), nil)
+	chainID := big.NewInt(1)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := sign(ks, tx, chainID, priv); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestExportECDSA(t *testing.T) {
+	dir, ks := tmpKeyStore(t)
+	defer os.RemoveAll(dir)
+
+	a, err := ks.NewAccount("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.ExportECDSA(a, "bar"); err != ErrDecrypt {
+		t.Errorf("wrong passphrase: have %v, want %v", err, ErrDecrypt)
+	}
+	priv, err := ks.ExportECDSA(a, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zeroKey(priv)
+
+	otherDir, other := tmpKeyStore(t)
+	defer os.RemoveAll(otherDir)
+	imported, err := other.ImportECDSA(priv, "baz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.Address != a.Address {
+		t.Errorf("imported address mismatch: have %x, want %x", imported.Address, a.Address)
+	}
+}
+
+func TestImportDuplicate(t *testing.T) {
+	dir, ks := tmpKeyStore(t)
+	defer os.RemoveAll(dir)
+
+	priv, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyJSON, err := EncryptKey(newKeyFromECDSA(priv), "foo", LightScryptN, LightScryptP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := ks.Import(keyJSON, "foo", "bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.Import(keyJSON, "foo", "bar"); err != ErrAccountAlreadyExists {
+		t.Errorf("second import: have %v, want %v", err, ErrAccountAlreadyExists)
+	}
+	if _, err := ks.ImportECDSA(priv, "bar"); err != ErrAccountAlreadyExists {
+		t.Errorf("ECDSA import: have %v, want %v", err, ErrAccountAlreadyExists)
+	}
+	replaced, err := ks.ImportKeyJSON(keyJSON, "foo", "baz", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replaced.URL != a.URL {
+		t.Errorf("overwrite wrote %s, want %s", replaced.URL, a.URL)
+	}
+	if accs := ks.Accounts(); len(accs) != 1 {
+		t.Errorf("account count mismatch: have %d, want 1", len(accs))
+	}
+	if err := ks.Unlock(a, "baz"); err != nil {
+		t.Errorf("overwritten key doesn't open with the new passphrase: %v", err)
+	}
+}
+
+func TestAccountID(t *testing.T) {
+	dir, ks := tmpKeyStore(t)
+	defer os.RemoveAll(dir)
+
+	a, err := ks.NewAccount("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := ks.AccountID(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !uuidV4.MatchString(id) {
+		t.Errorf("id %q is not a v4 UUID", id)
+	}
+
+	keyjson, err := ioutil.ReadFile(a.URL.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []string{``, `not-a-uuid`} {
+		var fields map[string]interface{}
+		if err := json.Unmarshal(keyjson, &fields); err != nil {
+			t.Fatal(err)
+		}
+		fields["id"] = bad
+		blob, _ := json.Marshal(fields)
+		if err := ioutil.WriteFile(a.URL.Path, blob, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ks.AccountID(a); err == nil {
+			t.Errorf("id %q: expected error", bad)
+		}
+	}
+}
+
+var uuidV4 = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestAccountChecksummed(t *testing.T) {
+	ks := new(KeyStore)
+	a := accounts.Account{
+		Address: common.HexToAddress("0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed"),
+		URL:     accounts.URL{Scheme: KeyStoreScheme, Path: filepath.Join("keys", "UTC--2018-07-06T00-00-00.000000000Z--5aaeb6053f3e94c9b9a09f33669435e7ef1beaed")},
+	}
+	want := filepath.Join("keys", "UTC--2018-07-06T00-00-00.000000000Z--5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed")
+	display := ks.AccountChecksummed(a)
+	if display.URL.Path != want {
+		t.Errorf("checksummed path mismatch: have %s, want %s", display.URL.Path, want)
+	}
+	if display.Address != a.Address || display.URL.Scheme != a.URL.Scheme {
+		t.Errorf("account altered beyond the path: %v", display)
+	}
+	custom := accounts.Account{Address: a.Address, URL: accounts.URL{Scheme: KeyStoreScheme, Path: "keys/main.json"}}
+	if display := ks.AccountChecksummed(custom); display != custom {
+		t.Errorf("custom file name altered: have %v, want %v", display, custom)
+	}
+}
+
+func TestImportBatchDuplicates(t *testing.T) {
+	dir, ks := tmpKeyStore(t)
+	defer os.RemoveAll(dir)
+
+	existing, err := ks.NewAccount("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	existingJSON, err := ks.Export(existing, "foo", "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyJSON, err := EncryptKey(newKeyFromECDSA(priv), "foo", LightScryptN, LightScryptP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := ks.ImportBatch(context.Background(), [][]byte{keyJSON, existingJSON, keyJSON}, "foo", "bar", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Err != nil || results[0].Account.Address != crypto.PubkeyToAddress(priv.PublicKey) {
+		t.Errorf("first copy not imported: %+v", results[0])
+	}
+	if results[1].Err != ErrAccountAlreadyExists {
+		t.Errorf("existing account: have %v, want %v", results[1].Err, ErrAccountAlreadyExists)
+	}
+	dup, ok := results[2].Err.(*DuplicateKeyError)
+	if !ok || dup.Index != 0 || dup.Addr != results[0].Account.Address {
+		t.Errorf("second copy: have %v, want duplicate of key 0", results[2].Err)
+	}
+	if accs := ks.Accounts(); len(accs) != 2 {
+		t.Errorf("account count mismatch: have %d, want 2", len(accs))
+	}
+}
+
+func TestImportAllDuplicates(t *testing.T) {
+	dir, ks := tmpKeyStore(t)
+	defer os.RemoveAll(dir)
+
+	priv, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyJSON, err := EncryptKey(newKeyFromECDSA(priv), "foo", LightScryptN, LightScryptP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := [][]byte{keyJSON, keyJSON, keyJSON, keyJSON}
+	if _, err := ks.ImportAll(context.Background(), batch, "foo", "bar", len(batch)); err != ErrAccountAlreadyExists {
+		t.Errorf("repeated key: have %v, want %v", err, ErrAccountAlreadyExists)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("key file count mismatch: have %d, want 1", len(files))
+	}
+}
+
+func TestNewKeyStoreMissingDir(t *testing.T) {
+	d, err := ioutil.TempDir("", "abaccount-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+
+	keydir := filepath.Join(d, "missing", "keystore")
+	ks := NewKeyStore(keydir, LightScryptN, LightScryptP)
+	if err := ks.Err(); err != nil {
+		t.Fatalf("unexpected keystore error: %v", err)
+	}
+	fi, err := os.Stat(keydir)
+	if err != nil {
+		t.Fatalf("keystore directory not created: %v", err)
+	}
+	if !fi.IsDir() || (runtime.GOOS != "windows" && fi.Mode().Perm() != 0700) {
+		t.Errorf("keystore directory mode mismatch: have %v, want directory with 0700", fi.Mode())
+	}
+	if accs := ks.Accounts(); len(accs) != 0 {
+		t.Errorf("empty keystore reports %d accounts", len(accs))
+	}
+}
+
+func TestECDSAPKDecompression(t *testing.T) {
+	priv, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed := ECDSAPKCompression(&priv.PublicKey)
+	pub, err := ECDSAPKDecompression(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub.X.Cmp(priv.X) != 0 || pub.Y.Cmp(priv.Y) != 0 {
+		t.Errorf("decompressed point mismatch: have (%x, %x), want (%x, %x)", pub.X, pub.Y, priv.X, priv.Y)
+	}
+
+	// Find an x without a curve point
+	params := crypto.S256().Params()
+	x := big.NewInt(1)
+	for {
+		y2 := new(big.Int).Exp(x, big.NewInt(3), params.P)
+		y2.Add(y2, params.B)
+		if new(big.Int).ModSqrt(y2.Mod(y2, params.P), params.P) == nil {
+			break
+		}
+		x.Add(x, common.Big1)
+	}
+	badPrefix := append([]byte{0x05}, compressed[1:]...)
+	tests := [][]byte{
+		badPrefix,
+		compressed[:32],
+		append([]byte{0x02}, math.PaddedBigBytes(params.P, 32)...),
+		append([]byte{0x03}, math.PaddedBigBytes(x, 32)...),
+	}
+	for _, point := range tests {
+		_, err := ECDSAPKDecompression(point)
+		perr, ok := err.(*InvalidCompressedPointError)
+		if !ok {
+			t.Errorf("point %x: have %v, want invalid compressed point error", point, err)
+			continue
+		}
+		if !bytes.Equal(perr.Point, point) {
+			t.Errorf("point %x: error reports %x", point, perr.Point)
+		}
+	}
+	if _, _, err := ParseABaddress(append(compressed, badPrefix...)); err == nil {
+		t.Error("AB address with an invalid S accepted")
+	}
+}
+
+func TestGetOneTimePubSets(t *testing.T) {
+	reader := &testPubSetReader{sets: map[int]string{3: "0x04aa", 5: "0x04bb,0x04cc", 7: "0x04dd"}}
+	sets, err := GetOneTimePubSets(reader, common.Address{}, []int{5, 3, 5, 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[int]string{3: "0x04aa", 5: "0x04bb,0x04cc", 7: "0x04dd"}; !reflect.DeepEqual(sets, want) {
+		t.Errorf("sets mismatch: have %v, want %v", sets, want)
+	}
+	if want := []int{5, 3, 7}; !reflect.DeepEqual(reader.reads, want) {
+		t.Errorf("slot reads mismatch: have %v, want %v", reader.reads, want)
+	}
+
+	reader = &testPubSetReader{sets: reader.sets, errs: map[int]error{7: errors.New("missing trie node")}}
+	sets, err = GetOneTimePubSets(reader, common.Address{}, []int{3, 7, 5})
+	if serr, ok := err.(*PubSetSlotError); !ok || serr.Slot != 7 {
+		t.Fatalf("have %v, want error of slot 7", err)
+	}
+	if want := map[int]string{3: "0x04aa"}; !reflect.DeepEqual(sets, want) {
+		t.Errorf("partial sets mismatch: have %v, want %v", sets, want)
+	}
+}
+
+func TestInjectedKeyOperations(t *testing.T) {
+	ks, a := unlockedTestKeyStore(t)
+	priv := ks.unlocked[a.Address].PrivateKey
+
+	hash := crypto.Keccak256([]byte("injected"))
+	sig, err := ks.SignHash(a, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := crypto.SigToPub(hash, sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if crypto.PubkeyToAddress(*signer) != a.Address {
+		t.Errorf("signature recovers %x, want %x", crypto.PubkeyToAddress(*signer), a.Address)
+	}
+
+	pub, err := ks.GetPublicKey(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := common.ToHex(crypto.FromECDSAPub(&priv.PublicKey)); pub != want {
+		t.Errorf("public key mismatch: have %s, want %s", pub, want)
+	}
+
+	ab := GenerateBaseABaddress(&priv.PublicKey)
+	A, S, err := ParseABaddress(ab[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if A.X.Cmp(priv.X) != 0 || A.Y.Cmp(priv.Y) != 0 {
+		t.Errorf("AB address A mismatch: have (%x, %x), want (%x, %x)", A.X, A.Y, priv.X, priv.Y)
+	}
+	base := crypto.ToECDSAPub(common.FromHex(B))
+	if S.X.Cmp(base.X) != 0 || S.Y.Cmp(base.Y) != 0 {
+		t.Errorf("AB address base mismatch: have (%x, %x), want (%x, %x)", S.X, S.Y, base.X, base.Y)
+	}
+
+	if _, err := ks.GetPublicKey(accounts.Account{Address: common.Address{1}}); err != ErrLocked {
+		t.Errorf("locked account: have %v, want %v", err, ErrLocked)
+	}
+}
+
+func TestAccountAttestationEncoding(t *testing.T) {
+	ab := append(append([]byte{0x02}, bytes.Repeat([]byte{0x33}, 32)...), append([]byte{0x03}, bytes.Repeat([]byte{0x44}, 32)...)...)
+	att := &AccountAttestation{
+		Accounts: []AttestedAccount{
+			{Address: common.BytesToAddress(bytes.Repeat([]byte{0x22}, 20)), ABaddress: ab},
+			{Address: common.BytesToAddress(bytes.Repeat([]byte{0x55}, 20))},
+		},
+		Timestamp: 1532880000,
+		Nonce:     []byte{1, 2, 3, 4, 5},
+		Signer:    common.BytesToAddress(bytes.Repeat([]byte{0x11}, 20)),
+	}
+	want := "757365636861696e206163636f756e74206174746573746174696f6e207631" + // tag
+		"1111111111111111111111111111111111111111" + // signer
+		"000000005b5de480" + "00000005" + "0102030405" + // timestamp, nonce
+		"00000002" +
+		"2222222222222222222222222222222222222222" + "42" +
+		"02" + "3333333333333333333333333333333333333333333333333333333333333333" +
+		"03" + "4444444444444444444444444444444444444444444444444444444444444444" +
+		"5555555555555555555555555555555555555555" + "00"
+	if have := common.Bytes2Hex(att.encode()); have != want {
+		t.Errorf("canonical encoding changed:\nhave %s\nwant %s", have, want)
+	}
+}
+
+func TestAttestAccounts(t *testing.T) {
+	dir, ks := tmpKeyStore(t)
+	defer os.RemoveAll(dir)
+
+	signer, err := ks.NewAccount("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.NewAccount("bar"); err != nil {
+		t.Fatal(err)
+	}
+	nonce := []byte("challenge")
+	att, err := ks.AttestAccounts(signer, "foo", nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(att.Accounts) != 2 {
+		t.Fatalf("attested %d accounts, want 2", len(att.Accounts))
+	}
+	if bytes.Compare(att.Accounts[0].Address[:], att.Accounts[1].Address[:]) >= 0 {
+		t.Errorf("attested accounts not sorted: %x, %x", att.Accounts[0].Address, att.Accounts[1].Address)
+	}
+	if err := VerifyAccountAttestation(att, signer.Address, nonce); err != nil {
+		t.Fatalf("valid attestation refused: %v", err)
+	}
+	if err := VerifyAccountAttestation(att, signer.Address, []byte("replayed")); err != ErrAttestationNonce {
+		t.Errorf("wrong nonce: have %v, want %v", err, ErrAttestationNonce)
+	}
+	att.Accounts = att.Accounts[:1]
+	if err := VerifyAccountAttestation(att, signer.Address, nonce); err != ErrAttestationSigner {
+		t.Errorf("truncated list: have %v, want %v", err, ErrAttestationSigner)
+	}
+	if _, err := ks.AttestAccounts(signer, "wrong", nonce); err != ErrDecrypt {
+		t.Errorf("wrong passphrase: have %v, want %v", err, ErrDecrypt)
+	}
+}
+
+func TestAttestationHashFunc(t *testing.T) {
+	dir, ks := tmpKeyStore(t)
+	defer os.RemoveAll(dir)
+	defer SetHashFunc(nil)
+
+	signer, err := ks.NewAccount("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := func(data ...[]byte) []byte {
+		return crypto.Keccak256(append([][]byte{[]byte("stub")}, data...)...)
+	}
+	SetHashFunc(stub)
+
+	nonce := []byte("challenge")
+	att, err := ks.AttestAccounts(signer, "foo", nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := crypto.SigToPub(stub(att.encode()), att.Signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if crypto.PubkeyToAddress(*pub) != signer.Address {
+		t.Error("attestation not signed over the stub hash")
+	}
+	if err := VerifyAccountAttestation(att, signer.Address, nonce); err != nil {
+		t.Errorf("verifying with the stub hash: %v", err)
+	}
+	SetHashFunc(nil)
+	if err := VerifyAccountAttestation(att, signer.Address, nonce); err != ErrAttestationSigner {
+		t.Errorf("stub hash attestation under keccak256: have %v, want %v", err, ErrAttestationSigner)
+	}
+}
+
+func TestImportAddressMismatch(t *testing.T) {
+	dir, ks := tmpKeyStore(t)
+	defer os.RemoveAll(dir)
+
+	priv, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyJSON, err := EncryptKey(newKeyFromECDSA(priv), "foo", LightScryptN, LightScryptP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(keyJSON, &fields); err != nil {
+		t.Fatal(err)
+	}
+	for _, claimed := range []string{"5aaeb6053f3e94c9b9a09f33669435e7ef1beaed", "not-an-address"} {
+		fields["address"] = claimed
+		tampered, _ := json.Marshal(fields)
+
+		if _, err := ks.Import(tampered, "foo", "bar"); err != ErrAddressMismatch {
+			t.Errorf("address %q import: have %v, want %v", claimed, err, ErrAddressMismatch)
+		}
+		if _, err := ks.UnlockJSON(tampered, "foo", 0); err != ErrAddressMismatch {
+			t.Errorf("address %q unlock: have %v, want %v", claimed, err, ErrAddressMismatch)
+		}
+	}
+	if accs := ks.Accounts(); len(accs) != 0 {
+		t.Errorf("tampered key imported: %v", accs)
+	}
+	if _, err := ks.Import(keyJSON, "foo", "bar"); err != nil {
+		t.Errorf("untampered key refused: %v", err)
+	}
+}
+
+func TestABaccountBundle(t *testing.T) {
+	dir, ks := tmpKeyStore(t)
+	defer os.RemoveAll(dir)
+	dir2, ks2 := tmpKeyStore(t)
+	defer os.RemoveAll(dir2)
+
+	main, err := ks.NewAccount("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.Unlock(main, "foo"); err != nil {
+		t.Fatal(err)
+	}
+	abAcc, ab, err := ks.NewABaccount(main, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.ExportABaccountBundle(main, "foo", "bar"); err != ErrNoABaddress {
+		t.Errorf("plain account export: have %v, want %v", err, ErrNoABaddress)
+	}
+	bundle, err := ks.ExportABaccountBundle(abAcc, "foo", "bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := common.CopyBytes(bundle)
+	tampered[10] ^= 0x01
+	if _, _, err := ks2.ImportABaccountBundle(tampered, "bar", "baz"); err != ErrBundleChecksum {
+		t.Errorf("tampered bundle: have %v, want %v", err, ErrBundleChecksum)
+	}
+	versioned := common.CopyBytes(bundle)
+	versioned[0] = abBundleVersion + 1
+	if _, _, err := ks2.ImportABaccountBundle(versioned, "bar", "baz"); err != ErrBundleVersion {
+		t.Errorf("unknown version: have %v, want %v", err, ErrBundleVersion)
+	}
+
+	imported, importedAB, err := ks2.ImportABaccountBundle(bundle, "bar", "baz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.Address != abAcc.Address || importedAB != ab {
+		t.Errorf("bundle round trip mismatch: have %x/%x, want %x/%x", imported.Address, importedAB, abAcc.Address, ab)
+	}
+	if err := ks2.Unlock(imported, "baz"); err != nil {
+		t.Fatalf("imported key doesn't open with the new passphrase: %v", err)
+	}
+	abHex, err := ks2.GetABaddr(imported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if abHex != common.Bytes2Hex(ab[:]) {
+		t.Errorf("imported AB address mismatch: have %s, want %x", abHex, ab)
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2018 The go-usechain Authors
+// This file is part of the go-usechain library.
+//
+// The go-usechain library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-usechain library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-usechain library. If not, see <http://www.gnu.org/licenses/>.
+
+package ABaccount
+
+import (
+	"sync"
+
+	"github.com/usechain/go-usechain/crypto"
+)
+
+// msgHashFunc is the hash signed messages are signed and verified over, shared
+// by the account attestations here and the committee messages.
+var (
+	msgHashFunc     = crypto.Keccak256
+	msgHashFuncLock sync.RWMutex
+)
+
+// SetHashFunc replaces the hash signed messages are signed and verified over,
+// for tests and alternate networks. A nil fn restores keccak256.
+//
+// The ring signature message is not covered: the ring signature is verified
+// against the plain message by the crypto package, which hashes it with
+// keccak256 itself. Neither are the hashes fixed by an existing format, such as
+// the contract's ABI selectors, the bundle checksums or the key derivations.
+func SetHashFunc(fn func(data ...[]byte) []byte) {
+	if fn == nil {
+		fn = crypto.Keccak256
+	}
+	msgHashFuncLock.Lock()
+	defer msgHashFuncLock.Unlock()
+
+	msgHashFunc = fn
+}
+
+// MsgHash hashes the data of a signed message with the configured hash.
+func MsgHash(data ...[]byte) []byte {
+	msgHashFuncLock.RLock()
+	defer msgHashFuncLock.RUnlock()
+
+	return msgHashFunc(data...)
+}
@@ -0,0 +1,212 @@
+// Copyright 2018 The go-usechain Authors
+// This file is part of the go-usechain library.
+//
+// The go-usechain library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-usechain library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-usechain library. If not, see <http://www.gnu.org/licenses/>.
+
+package ABaccount
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+
+	"github.com/usechain/go-usechain/accounts"
+	"github.com/usechain/go-usechain/common"
+)
+
+// OpType is the kind of key operation a signing policy is consulted for.
+type OpType int
+
+const (
+	OpSignHash OpType = iota // Signature over an arbitrary hash
+	OpSignTx                 // Transaction signature
+	OpRingSig                // Ring signature over a one-time public key set
+	OpABDerive               // Derivation of a new AB sub-account
+)
+
+var opTypeNames = map[OpType]string{
+	OpSignHash: "SignHash",
+	OpSignTx:   "SignTx",
+	OpRingSig:  "RingSig",
+	OpABDerive: "ABDerive",
+}
+
+func (t OpType) String() string {
+	if name, ok := opTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("OpType(%d)", int(t))
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (t OpType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (t *OpType) UnmarshalText(text []byte) error {
+	for op, name := range opTypeNames {
+		if name == string(text) {
+			*t = op
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown operation type %q", text)
+}
+
+// OpDescriptor describes a key operation about to be performed.
+type OpDescriptor struct {
+	Type    OpType
+	To      *common.Address // Transaction recipient, nil for contract creations and non-transactions
+	Value   *big.Int        // Transaction value, nil for non-transactions
+	ChainID *big.Int        // Transaction chain ID, nil for homestead signing and non-transactions
+}
+
+// Policy authorizes key operations per account. Allow returns nil to permit the
+// operation or an error describing why it is refused.
+type Policy interface {
+	Allow(account accounts.Account, op OpDescriptor) error
+}
+
+// PolicyDeniedError is returned by the keystore when the signing policy refuses
+// an operation. No key material is touched before the policy is consulted.
+type PolicyDeniedError struct {
+	Addr   common.Address
+	Op     OpType
+	Reason string
+}
+
+func (err *PolicyDeniedError) Error() string {
+	return fmt.Sprintf("%v denied for %x by signing policy: %s", err.Op, err.Addr, err.Reason)
+}
+
+// SetPolicy installs the signing policy consulted before every key operation.
+// A nil policy allows everything, which is the default.
+func (ks *KeyStore) SetPolicy(p Policy) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	ks.policy = p
+}
+
+// checkPolicy consults the signing policy for the operation. The caller must not
+// hold ks.mu.
+func (ks *KeyStore) checkPolicy(a accounts.Account, op OpDescriptor) error {
+	ks.mu.RLock()
+	policy := ks.policy
+	ks.mu.RUnlock()
+
+	if policy == nil {
+		return nil
+	}
+	if err := policy.Allow(a, op); err != nil {
+		return &PolicyDeniedError{Addr: a.Address, Op: op.Type, Reason: err.Error()}
+	}
+	return nil
+}
+
+// PolicyRule permits operations of a single account. Empty Ops permits every
+// operation type, empty To any transaction recipient, and a nil MaxValue any
+// transaction value.
+type PolicyRule struct {
+	Account  common.Address   `json:"account"`
+	Ops      []OpType         `json:"ops,omitempty"`
+	To       []common.Address `json:"to,omitempty"`
+	MaxValue *big.Int         `json:"maxValue,omitempty"`
+}
+
+// RulePolicy is a Policy permitting the operations matched by its rules. Accounts
+// without any rule fall back to DefaultAllow.
+type RulePolicy struct {
+	DefaultAllow bool         `json:"defaultAllow"`
+	Rules        []PolicyRule `json:"rules"`
+}
+
+// LoadRulePolicy reads a rule based policy from a JSON file, e.g.
+//
+//	{
+//	  "defaultAllow": true,
+//	  "rules": [
+//	    {"account": "0x1c...", "ops": ["SignTx"], "to": ["0xfffffffffffffffffffffffffffffffff0000001"]},
+//	    {"account": "0x7e...", "ops": ["SignTx", "RingSig", "ABDerive"], "maxValue": 1000000000000000000}
+//	  ]
+//	}
+func LoadRulePolicy(path string) (*RulePolicy, error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	policy := new(RulePolicy)
+	if err := json.Unmarshal(blob, policy); err != nil {
+		return nil, fmt.Errorf("invalid signing policy %s: %v", path, err)
+	}
+	return policy, nil
+}
+
+// Allow implements Policy.
+func (p *RulePolicy) Allow(account accounts.Account, op OpDescriptor) error {
+	reason := ""
+	for _, rule := range p.Rules {
+		if rule.Account != account.Address {
+			continue
+		}
+		if reason = rule.match(op); reason == "" {
+			return nil
+		}
+	}
+	switch {
+	case reason != "":
+		return errors.New(reason)
+	case !p.DefaultAllow:
+		return errors.New("no rule for account")
+	}
+	return nil
+}
+
+// match returns why the rule doesn't permit the operation, or "" if it does.
+func (r *PolicyRule) match(op OpDescriptor) string {
+	if len(r.Ops) > 0 && !containsOp(r.Ops, op.Type) {
+		return fmt.Sprintf("operation %v not permitted", op.Type)
+	}
+	if op.Type != OpSignTx {
+		return ""
+	}
+	if len(r.To) > 0 && (op.To == nil || !containsAddress(r.To, *op.To)) {
+		return "transaction recipient not permitted"
+	}
+	if r.MaxValue != nil && op.Value != nil && op.Value.Cmp(r.MaxValue) > 0 {
+		return fmt.Sprintf("transaction value %v exceeds %v", op.Value, r.MaxValue)
+	}
+	return ""
+}
+
+func containsOp(ops []OpType, op OpType) bool {
+	for _, o := range ops {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAddress(addrs []common.Address, addr common.Address) bool {
+	for _, a := range addrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,179 @@
+// Copyright 2018 The go-usechain Authors
+// This file is part of the go-usechain library.
+//
+// The go-usechain library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-usechain library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-usechain library. If not, see <http://www.gnu.org/licenses/>.
+
+package ABaccount
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	crand "crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/usechain/go-usechain/common"
+	"github.com/usechain/go-usechain/common/hexutil"
+	"github.com/usechain/go-usechain/common/math"
+	"github.com/usechain/go-usechain/crypto"
+)
+
+// Default maximum age of a sealed unlocked state accepted by RestoreUnlockedState.
+const defaultSealMaxAge = 5 * time.Minute
+
+var (
+	ErrSealKey    = errors.New("seal key must be 32 bytes")
+	ErrSealOpen   = errors.New("could not open sealed state, wrong seal key or corrupt blob")
+	ErrSealStale  = errors.New("sealed state is older than the maximum age")
+	ErrSealFuture = errors.New("sealed state is dated in the future")
+)
+
+// sealedKey is a single unlocked key inside a sealed state.
+type sealedKey struct {
+	PrivateKey hexutil.Bytes    `json:"key"`
+	ABaddress  common.ABaddress `json:"abaddress"`
+	Remaining  time.Duration    `json:"remaining"` // Zero for keys unlocked indefinitely
+}
+
+// sealedState is the plaintext of a sealed unlocked state.
+type sealedState struct {
+	Sealed time.Time   `json:"sealed"`
+	Keys   []sealedKey `json:"keys"`
+}
+
+// SetSealMaxAge sets the maximum age of sealed states accepted for restoring.
+func (ks *KeyStore) SetSealMaxAge(age time.Duration) error {
+	if age <= 0 {
+		return fmt.Errorf("invalid seal max age %v", age)
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	ks.sealMaxAge = age
+	return nil
+}
+
+// SealUnlockedState encrypts the currently unlocked keys, along with their
+// remaining unlock timeouts, under the given 32 byte ephemeral key for a
+// controlled restart. The blob is returned to the caller and never written to
+// disk by the keystore.
+func (ks *KeyStore) SealUnlockedState(sealKey []byte) ([]byte, error) {
+	aead, err := newSealAEAD(sealKey)
+	if err != nil {
+		return nil, err
+	}
+	ks.mu.RLock()
+	state := sealedState{Sealed: time.Now()}
+	for _, u := range ks.unlocked {
+		key := sealedKey{
+			PrivateKey: math.PaddedBigBytes(u.PrivateKey.D, 32),
+			ABaddress:  u.ABaddress,
+		}
+		if !u.expires.IsZero() {
+			if key.Remaining = u.expires.Sub(state.Sealed); key.Remaining <= 0 {
+				continue
+			}
+		}
+		state.Keys = append(state.Keys, key)
+	}
+	ks.mu.RUnlock()
+
+	defer func() {
+		for _, key := range state.Keys {
+			zeroBytes(key.PrivateKey)
+		}
+	}()
+	plain, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroBytes(plain)
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := crand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, nil), nil
+}
+
+// RestoreUnlockedState unlocks the keys of a blob produced by SealUnlockedState
+// and restarts their expiry timers with the time left at sealing minus the time
+// elapsed since. Blobs older than the maximum seal age are refused.
+func (ks *KeyStore) RestoreUnlockedState(blob, sealKey []byte) error {
+	aead, err := newSealAEAD(sealKey)
+	if err != nil {
+		return err
+	}
+	if len(blob) < aead.NonceSize() {
+		return ErrSealOpen
+	}
+	plain, err := aead.Open(nil, blob[:aead.NonceSize()], blob[aead.NonceSize():], nil)
+	if err != nil {
+		return ErrSealOpen
+	}
+	defer zeroBytes(plain)
+
+	var state sealedState
+	if err := json.Unmarshal(plain, &state); err != nil {
+		return err
+	}
+	defer func() {
+		for _, key := range state.Keys {
+			zeroBytes(key.PrivateKey)
+		}
+	}()
+	ks.mu.RLock()
+	maxAge := ks.sealMaxAge
+	ks.mu.RUnlock()
+	if maxAge <= 0 {
+		maxAge = defaultSealMaxAge
+	}
+	elapsed := time.Since(state.Sealed)
+	switch {
+	case elapsed < 0:
+		return ErrSealFuture
+	case elapsed > maxAge:
+		return ErrSealStale
+	}
+	for _, sealed := range state.Keys {
+		timeout := time.Duration(0)
+		if sealed.Remaining > 0 {
+			if timeout = sealed.Remaining - elapsed; timeout <= 0 {
+				continue
+			}
+		}
+		priv, err := crypto.ToECDSA(sealed.PrivateKey)
+		if err != nil {
+			return err
+		}
+		key := newKeyFromECDSA(priv)
+		key.ABaddress = sealed.ABaddress
+		ks.unlockKey(key.Address, key, timeout)
+	}
+	return nil
+}
+
+// newSealAEAD creates the AES-256-GCM cipher sealing unlocked states.
+func newSealAEAD(sealKey []byte) (cipher.AEAD, error) {
+	if len(sealKey) != 32 {
+		return nil, ErrSealKey
+	}
+	block, err := aes.NewCipher(sealKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,145 @@
+// Copyright 2018 The go-usechain Authors
+// This file is part of the go-usechain library.
+//
+// The go-usechain library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-usechain library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-usechain library. If not, see <http://www.gnu.org/licenses/>.
+
+package committee
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/usechain/go-usechain/common"
+)
+
+var ErrCursorFull = errors.New("cert cursor is full, prune the finalized certs")
+
+/*
+ *  The discovery cursor over the unconfirmed registrations
+ *  Entries of the contract's unconfirmed list can be removed, expire or get
+ *  reordered, so an index watermark may skip or reprocess registrations.
+ *  The cursor tracks the processed certIDs instead, persisted at path
+ */
+type CertCursor struct {
+	path      string
+	limit     int
+	processed map[string]struct{}
+	lock      sync.Mutex
+}
+
+/*
+ *  New a cursor persisted at path, holding at most limit unfinalized certs
+ *  An existing cursor file is loaded, an empty path keeps it in memory only
+ */
+func NewCertCursor(path string, limit int) (*CertCursor, error) {
+	c := &CertCursor{path: path, limit: limit, processed: make(map[string]struct{})}
+	if path == "" {
+		return c, nil
+	}
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var certIDs []string
+	if err := json.Unmarshal(raw, &certIDs); err != nil {
+		return nil, err
+	}
+	for _, certID := range certIDs {
+		c.processed[certID] = struct{}{}
+	}
+	return c, nil
+}
+
+/*
+ *  Filter the certIDs read from the unconfirmed list in one cycle
+ *  Return the unprocessed ones in read order, skipping gaps & duplicates
+ */
+func (c *CertCursor) Pending(certIDs []string) []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	pending := []string{}
+	seen := make(map[string]bool)
+	for _, certID := range certIDs {
+		if certID == "" || certID == (common.Hash{}).Hex() || seen[certID] {
+			continue
+		}
+		seen[certID] = true
+		if _, ok := c.processed[certID]; !ok {
+			pending = append(pending, certID)
+		}
+	}
+	return pending
+}
+
+/*
+ *  Record the cert as processed & persist the cursor
+ */
+func (c *CertCursor) MarkProcessed(certID string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.processed[certID]; ok {
+		return nil
+	}
+	if c.limit > 0 && len(c.processed) >= c.limit {
+		return ErrCursorFull
+	}
+	c.processed[certID] = struct{}{}
+	return c.save()
+}
+
+/*
+ *  Drop the finalized certs, which never show up in the unconfirmed list again
+ */
+func (c *CertCursor) Prune(finalized []string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, certID := range finalized {
+		delete(c.processed, certID)
+	}
+	return c.save()
+}
+
+/*
+ *  Write the processed certs, the caller must hold the lock
+ */
+func (c *CertCursor) save() error {
+	if c.path == "" {
+		return nil
+	}
+	certIDs := make([]string, 0, len(c.processed))
+	for certID := range c.processed {
+		certIDs = append(certIDs, certID)
+	}
+	sort.Strings(certIDs)
+
+	content, err := json.Marshal(certIDs)
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
@@ -0,0 +1,199 @@
+// Copyright 2018 The go-usechain Authors
+// This file is part of the go-usechain library.
+//
+// The go-usechain library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-usechain library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-usechain library. If not, see <http://www.gnu.org/licenses/>.
+
+package committee
+
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/usechain/go-usechain/common"
+)
+
+// processCycle runs one discovery cycle over the read certIDs and returns the
+// certs processed by it.
+func processCycle(t *testing.T, c *CertCursor, certIDs ...string) []string {
+	pending := c.Pending(certIDs)
+	for _, certID := range pending {
+		if err := c.MarkProcessed(certID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return pending
+}
+
+func TestCertCursor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cert-cursor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cursor.json")
+
+	c, err := NewCertCursor(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := processCycle(t, c, "a", "b", "c"); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Fatalf("first cycle: have %v, want [a b c]", got)
+	}
+	// b disappears between cycles, d takes over index 2
+	if got := processCycle(t, c, "a", "c", "d"); !reflect.DeepEqual(got, []string{"d"}) {
+		t.Errorf("entry removed: have %v, want [d]", got)
+	}
+	// the index shrinks after a contract upgrade, with gaps and duplicates
+	c, err = NewCertCursor(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := processCycle(t, c, "c", "", (common.Hash{}).Hex(), "e", "e"); !reflect.DeepEqual(got, []string{"e"}) {
+		t.Errorf("index shrunk: have %v, want [e]", got)
+	}
+	if got := processCycle(t, c, "a", "b", "c", "d", "e"); len(got) != 0 {
+		t.Errorf("reprocessed certs: %v", got)
+	}
+}
+
+func TestCertCursorPrune(t *testing.T) {
+	c, err := NewCertCursor("", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	processCycle(t, c, "a", "b")
+	if err := c.MarkProcessed("c"); err != ErrCursorFull {
+		t.Fatalf("full cursor: have %v, want %v", err, ErrCursorFull)
+	}
+	if err := c.Prune([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := processCycle(t, c, "b", "c"); !reflect.DeepEqual(got, []string{"c"}) {
+		t.Errorf("after pruning: have %v, want [c]", got)
+	}
+}
+
+// testContractState serves the authentication contract storage from memory.
+type testContractState map[common.Hash]common.Hash
+
+func (s testContractState) GetState(addr common.Address, key common.Hash) common.Hash {
+	return s[key]
+}
+
+// putSlot stores the certID word at the index-th slot of the unconfirmed list,
+// zero clears the slot.
+func (s testContractState) putSlot(t *testing.T, index int64, certID int64) {
+	key, err := UnconfirmedAddressStorageKey(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s[key] = common.BigToHash(big.NewInt(certID))
+}
+
+// putCert stores the ringSig & pubSkey of the certID, each under 32 bytes.
+func (s testContractState) putCert(t *testing.T, certID int64, ringSig, pubSKey string) {
+	key, err := CertToAddressStorageKey(certID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certAddr := common.BigToHash(big.NewInt(certID + 1000))
+	s[key] = certAddr
+
+	for field, data := range map[int64]string{certRingSigField: ringSig, certPubSKeyField: pubSKey} {
+		lenKey, dataKeys, err := certFieldKeys(certAddr, field, int64(2*len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s[lenKey] = common.BigToHash(big.NewInt(int64(2 * len(data))))
+		var word common.Hash
+		copy(word[:], data)
+		s[dataKeys[0]] = word
+	}
+}
+
+// readCycle runs one discovery cycle over the first n slots and returns the
+// certIDs read by it, as integers.
+func readCycle(t *testing.T, reader testContractState, c *CertCursor, n int64) []int64 {
+	contract := common.HexToAddress(common.AuthenticationContractAddressString)
+	read := []int64{}
+	for _, cert := range readPendingCerts(reader, contract, c, n) {
+		if cert.Err != nil {
+			t.Errorf("cert %s: %v", cert.CertID, cert.Err)
+			continue
+		}
+		certID := common.HexToHash(cert.CertID).Big().Int64()
+		if want := "sig" + big.NewInt(certID).String(); cert.RingSig != want || cert.PubSKey != "pub" {
+			t.Errorf("cert %d fields mismatch: have (%q, %q)", certID, cert.RingSig, cert.PubSKey)
+		}
+		if err := c.MarkProcessed(cert.CertID); err != nil {
+			t.Fatal(err)
+		}
+		read = append(read, certID)
+	}
+	return read
+}
+
+func TestReadPendingCerts(t *testing.T) {
+	reader := make(testContractState)
+	for certID := int64(1); certID <= 5; certID++ {
+		reader.putCert(t, certID, "sig"+big.NewInt(certID).String(), "pub")
+	}
+	c, err := NewCertCursor("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, certID := range []int64{1, 2, 3} {
+		reader.putSlot(t, int64(i), certID)
+	}
+	if got := readCycle(t, reader, c, 3); !reflect.DeepEqual(got, []int64{1, 2, 3}) {
+		t.Fatalf("first cycle: have %v, want [1 2 3]", got)
+	}
+	// 2 disappears, 3 moves down & 4 takes over its slot
+	reader.putSlot(t, 1, 3)
+	reader.putSlot(t, 2, 4)
+	if got := readCycle(t, reader, c, 3); !reflect.DeepEqual(got, []int64{4}) {
+		t.Errorf("entry removed: have %v, want [4]", got)
+	}
+	// The list shrinks to a single entry, then grows again
+	reader.putSlot(t, 1, 0)
+	reader.putSlot(t, 2, 0)
+	if got := readCycle(t, reader, c, 1); len(got) != 0 {
+		t.Errorf("index shrunk: reprocessed %v", got)
+	}
+	reader.putSlot(t, 1, 5)
+	if got := readCycle(t, reader, c, 3); !reflect.DeepEqual(got, []int64{5}) {
+		t.Errorf("index grown: have %v, want [5]", got)
+	}
+
+	// A cert with an oversized field is reported & left unprocessed
+	reader.putSlot(t, 2, 6)
+	key, _ := CertToAddressStorageKey(6)
+	certAddr := common.BigToHash(big.NewInt(1006))
+	reader[key] = certAddr
+	lenKey, _ := certFieldLenKey(certAddr, certRingSigField)
+	reader[common.HexToHash(lenKey)] = common.BigToHash(big.NewInt(int64(2*currentLimits().MaxDynamicBytes + 2)))
+
+	contract := common.HexToAddress(common.AuthenticationContractAddressString)
+	for i := 0; i < 2; i++ {
+		certs := readPendingCerts(reader, contract, c, 3)
+		if len(certs) != 1 || certs[0].Err == nil || !strings.Contains(certs[0].Err.Error(), "ring sig") {
+			t.Fatalf("oversized cert: have %+v", certs)
+		}
+	}
+}
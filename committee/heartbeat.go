@@ -0,0 +1,84 @@
+// Copyright 2018 The go-usechain Authors
+// This file is part of the go-usechain library.
+//
+// The go-usechain library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-usechain library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-usechain library. If not, see <http://www.gnu.org/licenses/>.
+
+package committee
+
+import (
+	"crypto/ecdsa"
+	"encoding/binary"
+	"errors"
+
+	"github.com/usechain/go-usechain/accounts/keystore"
+	"github.com/usechain/go-usechain/common"
+	"github.com/usechain/go-usechain/crypto"
+)
+
+// The heartbeat payload, address || timestamp
+// 20 bytes committee member address, 8 bytes big-endian unix timestamp
+const heartbeatLength = common.AddressLength + 8
+
+var ErrInvalidHeartbeat = errors.New("invalid committee heartbeat")
+
+/*
+ *  The hash committee msgs are signed & verified over, configured by
+ *  keystore.SetHashFunc along with the account attestations
+ *  The contract's ABI selectors keep using keccak256, they're fixed by the contract
+ */
+func msgHash(data []byte) []byte {
+	return keystore.MsgHash(data)
+}
+
+/*
+ *  Build the heartbeat payload of the committee member at the timestamp
+ */
+func BuildCommitteeHeartbeat(from common.Address, timestamp int64) []byte {
+	payload := make([]byte, heartbeatLength)
+	copy(payload, from[:])
+	binary.BigEndian.PutUint64(payload[common.AddressLength:], uint64(timestamp))
+	return payload
+}
+
+/*
+ *  Sign the heartbeat with the committee member's key
+ *  Return the payload & the signature over its msg hash
+ */
+func SignCommitteeHeartbeat(priv *ecdsa.PrivateKey, timestamp int64) ([]byte, []byte, error) {
+	payload := BuildCommitteeHeartbeat(crypto.PubkeyToAddress(priv.PublicKey), timestamp)
+	sig, err := crypto.Sign(msgHash(payload), priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	return payload, sig, nil
+}
+
+/*
+ *  Verify the heartbeat was signed by the member it names
+ *  Return the member address & the heartbeat timestamp
+ */
+func VerifyCommitteeHeartbeat(payload []byte, sig []byte) (common.Address, int64, error) {
+	if len(payload) != heartbeatLength {
+		return common.Address{}, 0, ErrInvalidHeartbeat
+	}
+	pub, err := crypto.SigToPub(msgHash(payload), sig)
+	if err != nil {
+		return common.Address{}, 0, err
+	}
+	from := common.BytesToAddress(payload[:common.AddressLength])
+	if crypto.PubkeyToAddress(*pub) != from {
+		return common.Address{}, 0, ErrInvalidHeartbeat
+	}
+	return from, int64(binary.BigEndian.Uint64(payload[common.AddressLength:])), nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2018 The go-usechain Authors
+// This file is part of the go-usechain library.
+//
+// The go-usechain library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-usechain library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-usechain library. If not, see <http://www.gnu.org/licenses/>.
+
+package committee
+
+import (
+	"testing"
+
+	"github.com/usechain/go-usechain/accounts/keystore"
+	"github.com/usechain/go-usechain/crypto"
+)
+
+func TestCommitteeHeartbeat(t *testing.T) {
+	priv, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const T = 1532880000
+	payload, sig, err := SignCommitteeHeartbeat(priv, T)
+	if err != nil {
+		t.Fatal(err)
+	}
+	from, timestamp, err := VerifyCommitteeHeartbeat(payload, sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := crypto.PubkeyToAddress(priv.PublicKey); from != want || timestamp != T {
+		t.Errorf("heartbeat mismatch: have %x@%d, want %x@%d", from, timestamp, want, T)
+	}
+	tampered := BuildCommitteeHeartbeat(from, T+60)
+	if _, _, err := VerifyCommitteeHeartbeat(tampered, sig); err == nil {
+		t.Error("accepted a heartbeat with a tampered timestamp")
+	}
+}
+
+func TestHeartbeatHashFunc(t *testing.T) {
+	defer keystore.SetHashFunc(nil)
+
+	stub := func(data ...[]byte) []byte {
+		return crypto.Keccak256(append([][]byte{[]byte("stub")}, data...)...)
+	}
+	keystore.SetHashFunc(stub)
+
+	priv, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, sig, err := SignCommitteeHeartbeat(priv, 1532880000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := crypto.SigToPub(stub(payload), sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if crypto.PubkeyToAddress(*pub) != crypto.PubkeyToAddress(priv.PublicKey) {
+		t.Error("heartbeat not signed over the stub hash")
+	}
+	if _, _, err := VerifyCommitteeHeartbeat(payload, sig); err != nil {
+		t.Errorf("verifying with the stub hash: %v", err)
+	}
+
+	keystore.SetHashFunc(nil)
+	if _, _, err := VerifyCommitteeHeartbeat(payload, sig); err == nil {
+		t.Error("stub hash signature verified under keccak256")
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2018 The go-usechain Authors
+// This file is part of the go-usechain library.
+//
+// The go-usechain library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-usechain library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-usechain library. If not, see <http://www.gnu.org/licenses/>.
+
+package committee
+
+import (
+	"fmt"
+	"sync"
+)
+
+/*
+ *  The bounds on the externally influenced inputs of the msg decoders & the
+ *  contract storage readers
+ *  An input exceeding a bound is refused before anything sized by it is allocated
+ */
+type Limits struct {
+	MaxMsgBytes     int // Length of a whole PubSharesMsg, header, shares & nonce
+	MaxSharesPerMsg int // Number of pub shares a PubSharesMsg may declare
+	MaxDynamicBytes int // Length of a dynamic bytes field read from the contract storage
+	MaxRingSize     int // Number of pub keys a ring signature may claim
+}
+
+// Generous defaults, a committee pub set never gets near them
+var DefaultLimits = Limits{
+	MaxMsgBytes:     266 + 132*1024 + 44,
+	MaxSharesPerMsg: 1024,
+	MaxDynamicBytes: 1 << 20,
+	MaxRingSize:     1024,
+}
+
+var limits = DefaultLimits
+var limitsLock sync.RWMutex
+
+/*
+ *  Replace the decoder limits, every bound must be positive
+ */
+func SetLimits(l Limits) error {
+	if l.MaxMsgBytes <= 0 || l.MaxSharesPerMsg <= 0 || l.MaxDynamicBytes <= 0 || l.MaxRingSize <= 0 {
+		return fmt.Errorf("invalid limits %+v", l)
+	}
+	limitsLock.Lock()
+	defer limitsLock.Unlock()
+
+	limits = l
+	return nil
+}
+
+func currentLimits() Limits {
+	limitsLock.RLock()
+	defer limitsLock.RUnlock()
+
+	return limits
+}
+
+/*
+ *  The error of an input exceeding one of the decoder limits
+ */
+type LimitExceededError struct {
+	Limit string
+	Have  int
+	Max   int
+}
+
+func (err *LimitExceededError) Error() string {
+	return fmt.Sprintf("%s limit exceeded: have %d, max %d", err.Limit, err.Have, err.Max)
+}
@@ -0,0 +1,142 @@
+// Copyright 2018 The go-usechain Authors
+// This file is part of the go-usechain library.
+//
+// The go-usechain library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-usechain library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-usechain library. If not, see <http://www.gnu.org/licenses/>.
+
+package committee
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/usechain/go-usechain/common"
+)
+
+// testLimitMsg builds a PubSharesMsg of n random shares with a round nonce.
+func testLimitMsg(t *testing.T, a1s1 string, n int) string {
+	return testPubShareMsg(a1s1, 21, 1, testPubShares(t, 1, n))
+}
+
+func TestMsgBytesLimit(t *testing.T) {
+	defer SetLimits(DefaultLimits)
+	a1s1 := testA1S1(t)
+	msg := testLimitMsg(t, a1s1, 2)
+
+	bounds := DefaultLimits
+	bounds.MaxMsgBytes, bounds.MaxSharesPerMsg = len(msg), 8
+	if err := SetLimits(bounds); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, _, _, err := ExtractPubShareMsg(msg); err != nil {
+		t.Errorf("msg at the bound: %v", err)
+	}
+	bounds.MaxMsgBytes = len(msg) - 1
+	SetLimits(bounds)
+	_, _, _, _, _, err := ExtractPubShareMsg(msg)
+	if lerr, ok := err.(*LimitExceededError); !ok || lerr.Have != len(msg) || lerr.Max != len(msg)-1 {
+		t.Errorf("msg above the bound: have %v, want msg bytes limit error", err)
+	}
+}
+
+func TestSharesPerMsgLimit(t *testing.T) {
+	defer SetLimits(DefaultLimits)
+	a1s1 := testA1S1(t)
+
+	bounds := DefaultLimits
+	bounds.MaxSharesPerMsg = 3
+	if err := SetLimits(bounds); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, _, _, err := ExtractPubShareMsg(testLimitMsg(t, a1s1, 3)); err != nil {
+		t.Errorf("shares at the bound: %v", err)
+	}
+	// The declared count is refused from the header alone, whatever the body
+	_, _, _, _, err := ParsePubShareHeader(testLimitMsg(t, a1s1, 4))
+	if lerr, ok := err.(*LimitExceededError); !ok || lerr.Have != 4 || lerr.Max != 3 {
+		t.Errorf("shares above the bound: have %v, want shares per msg limit error", err)
+	}
+
+	entries := []msgStoreEntry{{A1S1: a1s1, CertID: 21, SenderID: 1, Shares: testPubShares(t, 1, 4), Received: time.Now()}}
+	blob, err := json.Marshal(msgStoreSnapshot{Version: msgStoreVersion, Entries: entries})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadMsgStore(bytes.NewReader(blob)); err == nil {
+		t.Error("stored msg above the bound: expected error")
+	}
+	if _, ok := msgMap[a1s1]; ok {
+		delete(msgMap, a1s1)
+		t.Error("stored msg above the bound was loaded")
+	}
+}
+
+func TestSetLimitsValidation(t *testing.T) {
+	if err := SetLimits(Limits{MaxMsgBytes: 0, MaxSharesPerMsg: 1}); err == nil {
+		t.Error("expected error for a zero msg bytes limit")
+	}
+	if err := SetLimits(Limits{MaxMsgBytes: 1, MaxSharesPerMsg: -1}); err == nil {
+		t.Error("expected error for a negative shares limit")
+	}
+	if err := SetLimits(Limits{MaxMsgBytes: 1, MaxSharesPerMsg: 1, MaxDynamicBytes: 1}); err == nil {
+		t.Error("expected error for a zero ring size limit")
+	}
+	if currentLimits() != DefaultLimits {
+		t.Error("invalid limits were applied")
+	}
+}
+
+func TestDynamicBytesLimit(t *testing.T) {
+	defer SetLimits(DefaultLimits)
+	bounds := DefaultLimits
+	bounds.MaxDynamicBytes = 64
+	if err := SetLimits(bounds); err != nil {
+		t.Fatal(err)
+	}
+	certAddr := common.HexToHash("0x7e5e0b8d37fd1cd7ea7fa0d9ab9d0c62a7bd6a1f00")
+
+	// The length is in hex chars, two per byte
+	if _, dataKeys, err := certFieldKeys(certAddr, certRingSigField, 128); err != nil || len(dataKeys) != 3 {
+		t.Errorf("length at the bound: have %d keys (%v), want 3", len(dataKeys), err)
+	}
+	_, dataKeys, err := certFieldKeys(certAddr, certRingSigField, 130)
+	if lerr, ok := err.(*LimitExceededError); !ok || lerr.Have != 65 || lerr.Max != 64 || dataKeys != nil {
+		t.Errorf("length above the bound: have %v, want dynamic bytes limit error", err)
+	}
+	if _, _, err := certFieldKeys(certAddr, certPubSKeyField, -2); err == nil {
+		t.Error("negative length: expected error")
+	}
+}
+
+func TestRingSizeLimit(t *testing.T) {
+	defer SetLimits(DefaultLimits)
+	bounds := DefaultLimits
+	bounds.MaxRingSize = 3
+	if err := SetLimits(bounds); err != nil {
+		t.Fatal(err)
+	}
+	reader := testPubSetReader("0x04aa,0x04bb,0x04cc")
+	if ok, err := verifyPubSet(reader, common.Address{}, 5, "0x04aa,0x04bb,0x04cc"); !ok || err != nil {
+		t.Errorf("ring at the bound: have (%v, %v), want (true, nil)", ok, err)
+	}
+	_, err := verifyPubSet(reader, common.Address{}, 5, "0x04aa,0x04bb,0x04cc,0x04aa")
+	if lerr, ok := err.(*LimitExceededError); !ok || lerr.Have != 4 || lerr.Max != 3 {
+		t.Errorf("ring above the bound: have %v, want ring size limit error", err)
+	}
+	reader = testPubSetReader("0x04aa,0x04bb,0x04cc,0x04dd")
+	if _, err := verifyPubSet(reader, common.Address{}, 5, "0x04aa"); err == nil {
+		t.Error("on-chain set above the bound: expected error")
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2018 The go-usechain Authors
+// This file is part of the go-usechain library.
+//
+// The go-usechain library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-usechain library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-usechain library. If not, see <http://www.gnu.org/licenses/>.
+
+package committee
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"strings"
+
+	"github.com/usechain/go-usechain/accounts/keystore"
+	"github.com/usechain/go-usechain/common/math"
+)
+
+const (
+	committeeShareVersion = 1
+	committeeShareLength  = 88 // 44 bytes base64 share ID + 44 bytes base64 scalar
+)
+
+/*
+ *  The committee member's Shamir share
+ *  ID is the 44 bytes base64 encoded share index, Share the private scalar
+ */
+type CommitteeMember struct {
+	ID    string
+	Share *big.Int
+}
+
+/*
+ *  The committee share file, the share encrypted with the Web3 secret
+ *  storage scrypt envelope used by the account key files
+ */
+type committeeShareJSON struct {
+	Version int                 `json:"version"`
+	Crypto  keystore.CryptoJSON `json:"crypto"`
+}
+
+/*
+ *  Load & decrypt the committee share from the file at path
+ *  Return the committee member holding the share
+ */
+func LoadCommitteeShare(path, passphrase string) (*CommitteeMember, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file committeeShareJSON
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return nil, err
+	}
+	if file.Version != committeeShareVersion {
+		return nil, errors.New("unsupported committee share file version")
+	}
+	plain, err := keystore.DecryptDataV3(file.Crypto, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroBytes(plain)
+
+	return parseCommitteeShare(plain)
+}
+
+/*
+ *  Encrypt the committee member's share with the passphrase & write it to path
+ */
+func StoreCommitteeShare(path string, member *CommitteeMember, passphrase string, scryptN, scryptP int) error {
+	if len(member.ID) != 44 || member.Share == nil || member.Share.Sign() <= 0 || member.Share.BitLen() > 256 {
+		return errors.New("invalid committee share")
+	}
+	plain := encodeCommitteeShare(member)
+	defer zeroBytes(plain)
+
+	cryptoStruct, err := keystore.EncryptDataV3(plain, []byte(passphrase), scryptN, scryptP)
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(committeeShareJSON{Version: committeeShareVersion, Crypto: cryptoStruct})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, content, 0600)
+}
+
+/*
+ *  Build the 88 bytes ID & scalar share encoding, the scalar is encoded in
+ *  place so it's only ever held by buffers the caller zeroes
+ */
+func encodeCommitteeShare(member *CommitteeMember) []byte {
+	scalar := make([]byte, 32)
+	defer zeroBytes(scalar)
+	math.ReadBits(member.Share, scalar)
+
+	plain := make([]byte, committeeShareLength)
+	copy(plain, member.ID)
+	base64.URLEncoding.Encode(plain[44:], scalar)
+	return plain
+}
+
+/*
+ *  Parse the 88 bytes ID & scalar share encoding
+ */
+func parseCommitteeShare(plain []byte) (*CommitteeMember, error) {
+	if len(plain) != committeeShareLength {
+		return nil, errors.New("committee share gota invalided length")
+	}
+	scalar := make([]byte, base64.URLEncoding.DecodedLen(len(plain)-44))
+	defer zeroBytes(scalar)
+
+	n, err := base64.URLEncoding.Decode(scalar, plain[44:])
+	if err != nil || n != 32 {
+		return nil, errors.New("committee share scalar format error")
+	}
+	share := new(big.Int).SetBytes(scalar[:n])
+	if share.Sign() <= 0 {
+		return nil, errors.New("committee share scalar format error")
+	}
+	return &CommitteeMember{ID: string(plain[:44]), Share: share}, nil
+}
+
+/*
+ *  Convert a 44 bytes base64 Shamir share encoding to 64 hex digits
+ */
+func ShareToHex(b64 string) (string, error) {
+	if len(b64) != 44 {
+		return "", errors.New("share encoding must be 44 bytes base64")
+	}
+	raw, err := base64.URLEncoding.DecodeString(b64)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+/*
+ *  Convert 64 hex digits, optionally 0x prefixed, to the 44 bytes base64
+ *  Shamir share encoding
+ */
+func ShareFromHex(hexStr string) (string, error) {
+	hexStr = strings.TrimPrefix(strings.TrimPrefix(hexStr, "0x"), "0X")
+	if len(hexStr) != 64 {
+		return "", errors.New("share encoding must be 64 hex digits")
+	}
+	raw, err := hex.DecodeString(hexStr)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(raw), nil
+}
+
+func zeroBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2018 The go-usechain Authors
+// This file is part of the go-usechain library.
+//
+// The go-usechain library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-usechain library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-usechain library. If not, see <http://www.gnu.org/licenses/>.
+
+package committee
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// The msg store snapshot format version
+const msgStoreVersion = 1
+
+// Buffered pub shares older than the TTL are dropped from the live store and
+// when reloading it
+var MsgStoreTTL = time.Hour
+
+// The minimal interval between two prunes of the live store on intake
+var msgStorePruneInterval = time.Minute
+
+var lastMsgStorePrune time.Time
+var lastMsgStorePruneLock sync.Mutex
+
+/*
+ *  The snapshot entries LoadMsgStore couldn't restore, by entry index
+ */
+type MsgStoreLoadError struct {
+	Errs map[int]error
+}
+
+func (e *MsgStoreLoadError) Error() string {
+	return fmt.Sprintf("%d msg store entries not restored", len(e.Errs))
+}
+
+type msgStoreEntry struct {
+	A1S1     string    `json:"a1s1"`
+	CertID   int       `json:"certID"`
+	SenderID int       `json:"senderID"`
+	Shares   string    `json:"shares"`
+	Nonce    string    `json:"nonce"`
+	Received time.Time `json:"received"`
+}
+
+type msgStoreSnapshot struct {
+	Version int             `json:"version"`
+	Entries []msgStoreEntry `json:"entries"`
+}
+
+/*
+ *  Serialize the buffered pub shares, with their senders & receive times
+ */
+func SaveMsgStore(w io.Writer) error {
+	snapshot := msgStoreSnapshot{Version: msgStoreVersion, Entries: []msgStoreEntry{}}
+
+	msgLock.RLock()
+	for a1s1, msgs := range msgMap {
+		for _, msg := range msgs {
+			snapshot.Entries = append(snapshot.Entries, msgStoreEntry{
+				A1S1:     a1s1,
+				CertID:   msg.certID,
+				SenderID: msg.senderID,
+				Shares:   msg.shares,
+				Nonce:    msg.nonce,
+				Received: msg.received,
+			})
+		}
+	}
+	msgLock.RUnlock()
+
+	return json.NewEncoder(w).Encode(snapshot)
+}
+
+/*
+ *  Restore the pub shares saved by SaveMsgStore into the msg store
+ *  Entries older than MsgStoreTTL are dropped, the entries the store rejects,
+ *  such as the ones already in it, are skipped & reported by a
+ *  *MsgStoreLoadError once the others got restored
+ */
+func LoadMsgStore(r io.Reader) error {
+	var snapshot msgStoreSnapshot
+	if err := json.NewDecoder(r).Decode(&snapshot); err != nil {
+		return err
+	}
+	if snapshot.Version != msgStoreVersion {
+		return errors.New("unsupported msg store snapshot version")
+	}
+	bounds := currentLimits()
+	for _, entry := range snapshot.Entries {
+		if n := len(entry.Shares) / 132; n > bounds.MaxSharesPerMsg {
+			return &LimitExceededError{Limit: "shares per msg", Have: n, Max: bounds.MaxSharesPerMsg}
+		}
+		if len(entry.A1S1) != 132 {
+			return errors.New("msg store snapshot a1s1 format error")
+		}
+		if ok, _ := extractPubshare(entry.Shares); !ok || entry.Shares == "" {
+			return errors.New("msg store snapshot shares format error")
+		}
+	}
+
+	loadErr := &MsgStoreLoadError{Errs: make(map[int]error)}
+	for i, entry := range snapshot.Entries {
+		if time.Since(entry.Received) > MsgStoreTTL {
+			continue
+		}
+		msg := pubShareMsg{
+			certID:   entry.CertID,
+			senderID: entry.SenderID,
+			shares:   entry.Shares,
+			nonce:    entry.Nonce,
+			received: entry.Received,
+		}
+		if err := storePubShareMsg(entry.A1S1, msg); err != nil {
+			loadErr.Errs[i] = err
+		}
+	}
+	if len(loadErr.Errs) > 0 {
+		return loadErr
+	}
+	return nil
+}
+
+/*
+ *  Drop the stored pub shares older than MsgStoreTTL, the a1s1s left without
+ *  shares are removed along with their match caches
+ *  The round nonces are kept until their cert is finalized, an expired msg
+ *  replayed later is still refused
+ *  Return the number of dropped shares
+ */
+func PruneMsgStore() int {
+	a1ScanCacheLock.Lock()
+	defer a1ScanCacheLock.Unlock()
+	unmatchedPairsLock.Lock()
+	defer unmatchedPairsLock.Unlock()
+	msgLock.Lock()
+	defer msgLock.Unlock()
+
+	cutoff := time.Now().Add(-MsgStoreTTL)
+	pruned := 0
+	for a1s1, msgs := range msgMap {
+		kept := make([]pubShareMsg, 0, len(msgs))
+		for _, msg := range msgs {
+			if !msg.received.Before(cutoff) {
+				kept = append(kept, msg)
+			}
+		}
+		if len(kept) == len(msgs) {
+			continue
+		}
+		pruned += len(msgs) - len(kept)
+		if len(kept) == 0 {
+			delete(msgMap, a1s1)
+			delete(a1ScanCache, a1s1)
+			delete(unmatchedPairs, a1s1)
+			delete(publishedMatches, a1s1)
+			continue
+		}
+		msgMap[a1s1] = kept
+	}
+	return pruned
+}
+
+// pruneMsgStoreOnIntake prunes the live store at most once per
+// msgStorePruneInterval
+func pruneMsgStoreOnIntake() {
+	lastMsgStorePruneLock.Lock()
+	if time.Since(lastMsgStorePrune) < msgStorePruneInterval {
+		lastMsgStorePruneLock.Unlock()
+		return
+	}
+	lastMsgStorePrune = time.Now()
+	lastMsgStorePruneLock.Unlock()
+
+	PruneMsgStore()
+}
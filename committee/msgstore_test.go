@@ -0,0 +1,135 @@
+// Copyright 2018 The go-usechain Authors
+// This file is part of the go-usechain library.
+//
+// The go-usechain library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-usechain library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-usechain library. If not, see <http://www.gnu.org/licenses/>.
+
+package committee
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"testing"
+	"time"
+)
+
+func TestMsgStoreRoundTrip(t *testing.T) {
+	a1s1, bodies := testThresholdA1S1(t, 1, 2)
+	expired := testA1S1(t)
+	defer delete(msgMap, a1s1)
+	defer delete(msgMap, expired)
+	defer delete(seenNonces, 9)
+
+	for sender := 1; sender <= 2; sender++ {
+		if _, _, err := RegisterPubShareMsg(testPubShareMsg(a1s1, 9, sender, bodies[int64(sender)])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msgLock.Lock()
+	msgMap[expired] = []pubShareMsg{{certID: 9, senderID: 1, shares: testPubShares(t, 1, 1), received: time.Now().Add(-2 * MsgStoreTTL)}}
+	msgLock.Unlock()
+
+	var buf bytes.Buffer
+	if err := SaveMsgStore(&buf); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate a restart
+	delete(msgMap, a1s1)
+	delete(msgMap, expired)
+	delete(seenNonces, 9)
+
+	if err := LoadMsgStore(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := msgMap[expired]; ok {
+		t.Error("expired entry restored")
+	}
+	if missing := MissingShares(a1s1, []int{1, 2}); len(missing) != 0 {
+		t.Fatalf("senders lost across reload: %v", missing)
+	}
+	if !CheckGetValidA1S1(a1s1) {
+		t.Error("reloaded store no longer matches")
+	}
+	if len(seenNonces[9]) != 2 {
+		t.Errorf("round nonces not restored: have %d, want 2", len(seenNonces[9]))
+	}
+}
+
+func TestMsgStoreLoadErrors(t *testing.T) {
+	a1s1 := testA1S1(t)
+	defer RemoveA1S1(a1s1)
+	defer delete(seenNonces, 21)
+
+	for sender := 1; sender <= 2; sender++ {
+		if _, _, err := RegisterPubShareMsg(testPubShareMsg(a1s1, 21, sender, testPubShares(t, int64(sender), 1))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := SaveMsgStore(&buf); err != nil {
+		t.Fatal(err)
+	}
+	// Reloading into the live store rejects every entry already in it
+	err := LoadMsgStore(&buf)
+	loadErr, ok := err.(*MsgStoreLoadError)
+	if !ok {
+		t.Fatalf("reload error mismatch: have %v, want *MsgStoreLoadError", err)
+	}
+	if len(loadErr.Errs) < 2 {
+		t.Errorf("rejected entries mismatch: have %d, want at least 2", len(loadErr.Errs))
+	}
+	for i, err := range loadErr.Errs {
+		if err != ErrReplayedPubShare {
+			t.Errorf("entry %d: have %v, want %v", i, err, ErrReplayedPubShare)
+		}
+	}
+	if len(msgMap[a1s1]) != 2 {
+		t.Errorf("stored shares mismatch: have %d, want 2", len(msgMap[a1s1]))
+	}
+}
+
+func TestPruneMsgStore(t *testing.T) {
+	partial, expired := testA1S1(t), testA1S1(t)
+	defer RemoveA1S1(partial)
+	defer RemoveA1S1(expired)
+
+	old := time.Now().Add(-2 * MsgStoreTTL)
+	msgLock.Lock()
+	msgMap[partial] = []pubShareMsg{{senderID: 1, received: old}, {senderID: 2, received: time.Now()}}
+	msgMap[expired] = []pubShareMsg{{senderID: 1, received: old}}
+	msgLock.Unlock()
+	a1ScanCache[expired] = map[string]*ecdsa.PublicKey{}
+	unmatchedPairs[expired] = map[string]bool{"pair": true}
+	seenNonces[25] = map[string]bool{"old": true}
+	defer delete(seenNonces, 25)
+
+	if pruned := PruneMsgStore(); pruned < 2 {
+		t.Errorf("pruned shares mismatch: have %d, want at least 2", pruned)
+	}
+	if msgs := msgMap[partial]; len(msgs) != 1 || msgs[0].senderID != 2 {
+		t.Errorf("kept shares mismatch: %+v", msgs)
+	}
+	if _, ok := msgMap[expired]; ok {
+		t.Error("expired a1s1 kept")
+	}
+	if _, ok := a1ScanCache[expired]; ok {
+		t.Error("scan scope of the expired a1s1 kept")
+	}
+	if _, ok := unmatchedPairs[expired]; ok {
+		t.Error("unmatched pairs of the expired a1s1 kept")
+	}
+	// Round nonces outlive the expired shares until their cert is finalized
+	if !seenNonces[25]["old"] {
+		t.Error("round nonce of a pending cert expired")
+	}
+}
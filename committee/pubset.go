@@ -0,0 +1,76 @@
+// Copyright 2018 The go-usechain Authors
+// This file is part of the go-usechain library.
+//
+// The go-usechain library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-usechain library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-usechain library. If not, see <http://www.gnu.org/licenses/>.
+
+package committee
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/usechain/go-usechain/accounts/keystore"
+	"github.com/usechain/go-usechain/common"
+	"github.com/usechain/go-usechain/eth"
+)
+
+var ErrEmptyPubSet = errors.New("claimed pub set is empty")
+
+/*
+ *  Verify the pub set claimed by a ring signature against the contract's
+ *  one-time pubkey set at slot, every claimed key must be on chain
+ *  Return an error naming the first claimed key missing from the chain
+ */
+func VerifyPubSetAgainstChain(usechain *eth.Ethereum, contract common.Address, slot int, claimedSet string) (bool, error) {
+	return verifyPubSet(usechain.TxPool().State(), contract, slot, claimedSet)
+}
+
+func verifyPubSet(reader keystore.PubSetReader, contract common.Address, slot int, claimedSet string) (bool, error) {
+	if strings.TrimSpace(claimedSet) == "" {
+		return false, ErrEmptyPubSet
+	}
+	if err := checkRingSize(claimedSet); err != nil {
+		return false, err
+	}
+	onChainSet, err := reader.GetOneTimePubSet(contract, slot)
+	if err != nil {
+		return false, err
+	}
+	if err := checkRingSize(onChainSet); err != nil {
+		return false, err
+	}
+	onChain := make(map[string]bool)
+	for _, pub := range strings.Split(onChainSet, ",") {
+		onChain[normalizePubKey(pub)] = true
+	}
+	for i, pub := range strings.Split(claimedSet, ",") {
+		if !onChain[normalizePubKey(pub)] {
+			return false, fmt.Errorf("claimed pub key %d (%s) is not in the on-chain set of slot %d", i, pub, slot)
+		}
+	}
+	return true, nil
+}
+
+// checkRingSize bounds the number of pub keys of a comma separated set by MaxRingSize
+func checkRingSize(set string) error {
+	if n, max := strings.Count(set, ",")+1, currentLimits().MaxRingSize; n > max {
+		return &LimitExceededError{Limit: "ring size", Have: n, Max: max}
+	}
+	return nil
+}
+
+func normalizePubKey(pub string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(pub), "0x"))
+}
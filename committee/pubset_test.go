@@ -0,0 +1,49 @@
+// Copyright 2018 The go-usechain Authors
+// This file is part of the go-usechain library.
+//
+// The go-usechain library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-usechain library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-usechain library. If not, see <http://www.gnu.org/licenses/>.
+
+package committee
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/usechain/go-usechain/common"
+)
+
+// testPubSetReader serves a fixed one-time pubkey set for every slot.
+type testPubSetReader string
+
+func (r testPubSetReader) GetOneTimePubSet(contract common.Address, slot int) (string, error) {
+	return string(r), nil
+}
+
+func TestVerifyPubSet(t *testing.T) {
+	reader := testPubSetReader("0x04aa,0x04bb,0x04cc")
+	contract := common.HexToAddress(common.AuthenticationContractAddressString)
+
+	for _, claimed := range []string{"0x04aa,0x04bb,0x04cc", "0x04BB", "0x04cc,0x04aa"} {
+		if ok, err := verifyPubSet(reader, contract, 5, claimed); !ok || err != nil {
+			t.Errorf("claimed set %q rejected: %v", claimed, err)
+		}
+	}
+	ok, err := verifyPubSet(reader, contract, 5, "0x04aa,0x04dd")
+	if ok || err == nil || !strings.Contains(err.Error(), "0x04dd") {
+		t.Errorf("fabricated member accepted or not named: %v", err)
+	}
+	if _, err := verifyPubSet(reader, contract, 5, ""); err != ErrEmptyPubSet {
+		t.Errorf("empty set: have %v, want %v", err, ErrEmptyPubSet)
+	}
+}
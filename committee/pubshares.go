@@ -17,6 +17,7 @@
 package committee
 
 import (
+	"crypto/rand"
 	"fmt"
 	"github.com/usechain/go-usechain/accounts"
 	"github.com/usechain/go-usechain/accounts/keystore"
@@ -26,16 +27,22 @@ import (
 	"github.com/usechain/go-usechain/core/state"
 	"github.com/usechain/go-usechain/crypto"
 	"github.com/usechain/go-usechain/eth"
+	"github.com/usechain/go-usechain/event"
 	"github.com/usechain/go-usechain/log"
 	"github.com/usechain/go-usechain/core/types"
 	"crypto/ecdsa"
 	"math/big"
+	"sort"
 	"strconv"
+	"strings"
 	"errors"
 	"github.com/usechain/go-usechain/internal/ethapi"
 	"encoding/hex"
 	"bytes"
 	"github.com/usechain/go-usechain/cmd/utils"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 /*
@@ -46,62 +53,133 @@ func GeneratePubShare(pubSet []*ecdsa.PublicKey) string {
 	//privateShares := "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAE=Uv8TKu9w935MhVhKudhksXv1QQO_KijTVQ5yCWQNaL4="
 	privateShares := "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAI=dwOoQA6zD-kc0KQHm7srZ7sePn_pkOIalCZGbTD1WrI="
 
-	ID := privateShares[:44]
-	Shares := sssa.FromBase64(privateShares[44:])
+	member, err := parseCommitteeShare([]byte(privateShares))
+	if err != nil {
+		log.Error("Invalid compiled-in committee share", "err", err)
+		return ""
+	}
+	return member.GeneratePubShare(pubSet)
+}
 
+/*
+ * The member's share t_i, and
+ * return t_i * A for each A of the pub set
+ */
+func (m *CommitteeMember) GeneratePubShare(pubSet []*ecdsa.PublicKey) string {
 	var sharePubSet []ecdsa.PublicKey = make([]ecdsa.PublicKey, len(pubSet))
-	sharePubStr := ""
 
 	for i := range pubSet {
 		sharePubSet[i].Curve = crypto.S256()
-		sharePubSet[i].X, sharePubSet[i].Y = crypto.S256().ScalarMult(pubSet[i].X, pubSet[i].Y, Shares.Bytes())
-
-		fmt.Println("::::::::::::::::privateShares", pubSet[i])
+		sharePubSet[i].X, sharePubSet[i].Y = crypto.S256().ScalarMult(pubSet[i].X, pubSet[i].Y, m.Share.Bytes())
+	}
+	return assembleSharePubStr(m.ID, sharePubSet)
+}
 
-		sharePubStr = sharePubStr + ID + sssa.ToBase64(sharePubSet[i].X) + sssa.ToBase64(sharePubSet[i].Y)
+/*
+ *  Assemble the pub share string of the member id over the points
+ *  { pubNum: 44 bytes pubArray: [ ID: 44 bytes pub.X: 44 bytes pub.Y: 44 bytes ] }
+ */
+func assembleSharePubStr(id string, points []ecdsa.PublicKey) string {
+	var b strings.Builder
+	b.Grow(44 + len(points)*(len(id)+88))
 
+	b.WriteString(sssa.FormatData44bytes(strconv.Itoa(len(points))))
+	for i := range points {
+		b.WriteString(id)
+		b.WriteString(sssa.ToBase64(points[i].X))
+		b.WriteString(sssa.ToBase64(points[i].Y))
 	}
+	return b.String()
+}
 
-	sharePubStr = sssa.FormatData44bytes(strconv.Itoa(len(pubSet))) + sharePubStr
-	fmt.Println("sharePubStr:", sharePubStr)
-	return sharePubStr
+
+/*
+ *  Build the pubShareMsg of the committee sender for the certID
+ *  pubShare is the pubNum & pubArray generated by GeneratePubShare, nonce the
+ *  44 bytes round nonce binding the msg to a single round
+ */
+func BuildPubShareMsg(a1s1 string, certID int, senderID int, pubShare string, nonce string) string {
+	return "0x" + a1s1 +
+		sssa.FormatData44bytes(strconv.Itoa(certID)) +
+		sssa.FormatData44bytes(strconv.Itoa(senderID)) +
+		pubShare + nonce
 }
 
+/*
+ *  Generate a fresh random round nonce, 32 bytes base64 encoded
+ */
+func NewRoundNonce() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return sssa.ToBase64(new(big.Int).SetBytes(b)), nil
+}
 
 /*
  *  Extract the pubShareMsg
  *  The PubSharesMsg format
- *  { A1S1: 132 bytes  certID: 44 bytes  senderID: 44 bytes  pubNum: 44 bytes pubArray :[ ID : 44bytes pub.X: 44 bytes pub.Y: 44 bytes] }
- *  return the A1S1, certID, senderID, pubNum, pubArray
+ *  { A1S1: 132 bytes  certID: 44 bytes  senderID: 44 bytes  pubNum: 44 bytes pubArray :[ ID : 44bytes pub.X: 44 bytes pub.Y: 44 bytes] nonce: 44 bytes }
+ *  The nonce is empty for msgs built without one
+ *  return the A1S1, certID, senderID, pubArray, nonce
  */
-func ExtractPubShareMsg(msg string) (string, int, int, string, error){
+func ExtractPubShareMsg(msg string) (string, int, int, string, string, error){
 	if len(msg) < 266 + 132 {
-		return "", 0, 0, "", errors.New("pub share msg gota invalided length")
+		return "", 0, 0, "", "", errors.New("pub share msg gota invalided length")
 	}
 
-	A1S1 := msg[2:134]
-	certID, err := strconv.Atoi(msg[134:178])
+	A1S1, certID, senderID, pubSharesNum, err := ParsePubShareHeader(msg)
 	if err != nil {
-		return "", 0, 0, "", errors.New("pub shares msg format error")
+		return "", 0, 0, "", "", err
 	}
 
-	senderID, err := strconv.Atoi(msg[178:222])
-	if err != nil {
-		return "", 0, 0, "", errors.New("pub shares msg format error")
+	log.Debug("Pub shares msg", "num", pubSharesNum)
+	sharesEnd := 266 + 132 * pubSharesNum
+	if len(msg) < sharesEnd {
+		return "", 0, 0, "", "", errors.New("pub shares msg format error")
 	}
 
-	pubSharesNum, err := strconv.Atoi(msg[222:266])
-	if err != nil {
-		return "", 0, 0, "", errors.New("pub shares msg format error")
+	shares := msg[266:sharesEnd]
+	nonce := msg[sharesEnd:]
+	if nonce != "" && len(nonce) != 44 {
+		return "", 0, 0, "", "", errors.New("pub shares msg nonce format error")
 	}
+	return A1S1, certID, senderID, shares, nonce, nil
+}
 
-	log.Debug("pubSharesNum", pubSharesNum)
-	if err != nil || len(msg) < 266 + 132 * pubSharesNum {
-		return "", 0, 0, "", errors.New("pub shares msg format error")
+/*
+ *  Parse the 266 bytes header of the pubShareMsg only, leaving the body alone
+ *  { 0x: 2 bytes  A1S1: 132 bytes  certID: 44 bytes  senderID: 44 bytes  pubNum: 44 bytes }
+ *  The 0x prefix & the hex A1S1 are checked along with the numeric fields
+ *  return the A1S1, certID, senderID, pubNum
+ */
+func ParsePubShareHeader(msg string) (a1s1 string, certID, senderID, pubNum int, err error) {
+	if len(msg) < 266 {
+		return "", 0, 0, 0, errors.New("pub share msg header gota invalided length")
 	}
-
-	shares := msg[266:]
-	return A1S1, certID, senderID, shares, nil
+	bounds := currentLimits()
+	if len(msg) > bounds.MaxMsgBytes {
+		return "", 0, 0, 0, &LimitExceededError{Limit: "msg bytes", Have: len(msg), Max: bounds.MaxMsgBytes}
+	}
+	if msg[:2] != "0x" {
+		return "", 0, 0, 0, errors.New("pub shares msg prefix format error")
+	}
+	if _, err = hex.DecodeString(msg[2:134]); err != nil {
+		return "", 0, 0, 0, errors.New("pub shares msg A1S1 format error")
+	}
+	if certID, err = strconv.Atoi(msg[134:178]); err != nil {
+		return "", 0, 0, 0, errors.New("pub shares msg certID format error")
+	}
+	if senderID, err = strconv.Atoi(msg[178:222]); err != nil {
+		return "", 0, 0, 0, errors.New("pub shares msg senderID format error")
+	}
+	if pubNum, err = strconv.Atoi(msg[222:266]); err != nil || pubNum <= 0 {
+		return "", 0, 0, 0, errors.New("pub shares msg pubNum format error")
+	}
+	if pubNum > bounds.MaxSharesPerMsg {
+		return "", 0, 0, 0, &LimitExceededError{Limit: "shares per msg", Have: pubNum, Max: bounds.MaxSharesPerMsg}
+	}
+	return msg[2:134], certID, senderID, pubNum, nil
 }
 
 /*
@@ -121,78 +199,752 @@ func extractPubshare(pubShares string) (bool, []string){
 	return true, shares
 }
 
+/*
+ *  Aggregate the members' one-point pub shares t_i * A into the committee's
+ *  t * A, see AggregateCommitteePubSharesAll for shares over a pub set
+ */
+func AggregateCommitteePubShares(shares []string) (*ecdsa.PublicKey, error) {
+	aggregates, err := AggregateCommitteePubSharesAll(shares)
+	if err != nil {
+		return nil, err
+	}
+	if len(aggregates) != 1 {
+		return nil, fmt.Errorf("pub shares hold %d points, want one per member", len(aggregates))
+	}
+	return aggregates[0], nil
+}
+
+/*
+ *  Aggregate the members' pub shares over a pub set position-wise
+ *  Each share is a pub share as generated by GeneratePubShare, holding one
+ *  point per pub of the set; the points at the same position get summed
+ *  weighted by their members' Lagrange coefficients at zero
+ *  Return one aggregated pub per position, every share must hold as many
+ */
+func AggregateCommitteePubSharesAll(shares []string) ([]*ecdsa.PublicKey, error) {
+	if len(shares) < 2 {
+		return nil, errors.New("aggregating needs the pub shares of two members at least")
+	}
+	N := crypto.S256().Params().N
+	ids := make([]*big.Int, len(shares))
+	points := make([][]*ecdsa.PublicKey, len(shares))
+	seen := make(map[string]bool)
+
+	for i, share := range shares {
+		if len(share) < 44 {
+			return nil, fmt.Errorf("pub share %d gota invalided length", i)
+		}
+		pubNum, err := strconv.Atoi(share[:44])
+		if err != nil {
+			return nil, fmt.Errorf("pub share %d format error", i)
+		}
+		ok, pubs := extractPubshare(share[44:])
+		if !ok || len(pubs) != pubNum || pubNum == 0 {
+			return nil, fmt.Errorf("pub share %d count mismatch: have %d points, want %d", i, len(pubs), pubNum)
+		}
+		if i > 0 && pubNum != len(points[0]) {
+			return nil, fmt.Errorf("pub share %d holds %d points, pub share 0 holds %d", i, pubNum, len(points[0]))
+		}
+
+		id := sssa.FromBase64(pubs[0][:44])
+		if id.Sign() <= 0 || id.Cmp(N) >= 0 {
+			return nil, fmt.Errorf("pub share %d got an invalid member ID", i)
+		}
+		if seen[id.String()] {
+			return nil, fmt.Errorf("pub share %d duplicates member %v", i, id)
+		}
+		seen[id.String()] = true
+		ids[i] = id
+
+		for j, pub := range pubs {
+			if pub[:44] != pubs[0][:44] {
+				return nil, fmt.Errorf("pub share %d point %d got another member ID", i, j)
+			}
+			x, y := sssa.FromBase64(pub[44:88]), sssa.FromBase64(pub[88:])
+			if x.Sign() < 0 || y.Sign() < 0 || !crypto.S256().IsOnCurve(x, y) {
+				return nil, fmt.Errorf("pub share %d point %d is not a valid point", i, j)
+			}
+			points[i] = append(points[i], &ecdsa.PublicKey{Curve: crypto.S256(), X: x, Y: y})
+		}
+	}
+
+	// Lagrange coefficients of the members at zero
+	coeffs := make([]*big.Int, len(ids))
+	for i := range ids {
+		num, den := big.NewInt(1), big.NewInt(1)
+		for k := range ids {
+			if k != i {
+				num.Mul(num, new(big.Int).Neg(ids[k])).Mod(num, N)
+				den.Mul(den, new(big.Int).Sub(ids[i], ids[k])).Mod(den, N)
+			}
+		}
+		coeffs[i] = num.Mul(num, den.ModInverse(den, N)).Mod(num, N)
+	}
+
+	aggregates := make([]*ecdsa.PublicKey, len(points[0]))
+	for j := range aggregates {
+		aggregate := &ecdsa.PublicKey{Curve: crypto.S256()}
+		for i := range points {
+			x, y := crypto.S256().ScalarMult(points[i][j].X, points[i][j].Y, coeffs[i].Bytes())
+			if aggregate.X == nil {
+				aggregate.X, aggregate.Y = x, y
+			} else {
+				aggregate.X, aggregate.Y = crypto.S256().Add(aggregate.X, aggregate.Y, x, y)
+			}
+		}
+		if !crypto.S256().IsOnCurve(aggregate.X, aggregate.Y) {
+			return nil, fmt.Errorf("aggregated pub %d is not a valid point", j)
+		}
+		aggregates[j] = aggregate
+	}
+	return aggregates, nil
+}
+
 
 /*
  *  Simple history verify msg storage & check
+ *  Each a1s1 keeps the pub shares received from every committee sender
  */
 ///TODO: update the data storage
-var MsgMap = make(map[string][]string)
-var MsgCheckMap = make(map[string]([]int))
+type pubShareMsg struct {
+	certID   int
+	senderID int
+	shares   string
+	nonce    string
+	received time.Time
+}
+
+var msgMap = make(map[string][]pubShareMsg)
+var msgLock sync.RWMutex
+
+/*
+ *  The round nonces seen per pending certID, guarded by msgLock
+ *  They're kept until the cert is finalized, the finalized certs then reject
+ *  every msg, so a replay is refused in any later round
+ */
+var seenNonces = make(map[int]map[string]bool)
+var finalizedCerts = make(map[int]bool)
+
+/*
+ *  The round nonce is mandatory: a nonce-less msg can't be told apart from a
+ *  replay with the nonce stripped. Members still sending msgs without one
+ *  must upgrade, their msgs are rejected with ErrMissingNonce
+ */
+var (
+	ErrDuplicatePubShare = errors.New("pub shares msg already received from the sender")
+	ErrMissingNonce      = errors.New("pub shares msg without round nonce")
+	ErrReplayedPubShare  = errors.New("pub shares msg nonce already seen for the certID")
+	ErrFinalizedCert     = errors.New("pub shares msg for an already finalized certID")
+	ErrMatchTimeout      = errors.New("pub shares match timed out")
+)
 
 func InStringArraySet(a1s1 string, senderId int) bool{
-	if _, ok := MsgCheckMap[a1s1]; ok {
-		for i := range MsgCheckMap[a1s1] {
-			if i == senderId && MsgCheckMap[a1s1][i] == 1{
-				return true
-			}
+	msgLock.RLock()
+	defer msgLock.RUnlock()
+
+	return inMsgMap(a1s1, senderId)
+}
+
+// inMsgMap reports whether the sender already contributed to the a1s1,
+// the caller must hold msgLock
+func inMsgMap(a1s1 string, senderId int) bool {
+	for _, msg := range msgMap[a1s1] {
+		if msg.senderID == senderId {
+			return true
 		}
 	}
 	return false
 }
 
+// storedShares returns a snapshot of the pub shares received for the a1s1
+func storedShares(a1s1 string) []pubShareMsg {
+	msgLock.RLock()
+	defer msgLock.RUnlock()
+
+	return append([]pubShareMsg{}, msgMap[a1s1]...)
+}
+
+/*
+ *  Register a received pub share msg, the single intake of the msg store
+ *  Msgs without a round nonce, replaying one already seen for their certID or
+ *  for a finalized certID are rejected
+ *  Return the a1s1 & whether the stored shares got a matched account
+ */
+func RegisterPubShareMsg(msg string) (a1s1 string, matched bool, err error) {
+	a1s1, certID, senderID, shares, nonce, err := ExtractPubShareMsg(msg)
+	if err != nil {
+		return "", false, err
+	}
+	if ok, _ := extractPubshare(shares); !ok {
+		return a1s1, false, errors.New("pub shares msg format error")
+	}
+	if nonce == "" {
+		return a1s1, false, ErrMissingNonce
+	}
+	pruneMsgStoreOnIntake()
+
+	err = storePubShareMsg(a1s1, pubShareMsg{certID: certID, senderID: senderID, shares: shares, nonce: nonce, received: time.Now()})
+	if err != nil {
+		return a1s1, false, err
+	}
+	return a1s1, CheckGetValidA1S1(a1s1), nil
+}
+
+// storePubShareMsg stores the msg & invalidates the memoized scans of its a1s1
+func storePubShareMsg(a1s1 string, msg pubShareMsg) error {
+	a1ScanCacheLock.Lock()
+	defer a1ScanCacheLock.Unlock()
+	msgLock.Lock()
+	defer msgLock.Unlock()
+
+	if err := addPubShareMsg(a1s1, msg); err != nil {
+		return err
+	}
+	delete(a1ScanCache, a1s1)
+	return nil
+}
+
+/*
+ *  Drop the stored shares of the a1s1 along with its match caches, once its
+ *  cert got confirmed or rejected
+ */
+func RemoveA1S1(a1s1 string) {
+	a1ScanCacheLock.Lock()
+	defer a1ScanCacheLock.Unlock()
+	unmatchedPairsLock.Lock()
+	defer unmatchedPairsLock.Unlock()
+	msgLock.Lock()
+	defer msgLock.Unlock()
+
+	delete(msgMap, a1s1)
+	delete(a1ScanCache, a1s1)
+	delete(unmatchedPairs, a1s1)
+	delete(publishedMatches, a1s1)
+}
+
+// addPubShareMsg stores the msg after the replay & duplicate checks,
+// the caller must hold msgLock
+func addPubShareMsg(a1s1 string, msg pubShareMsg) error {
+	if msg.nonce == "" {
+		return ErrMissingNonce
+	}
+	if finalizedCerts[msg.certID] {
+		return ErrFinalizedCert
+	}
+	if seenNonces[msg.certID][msg.nonce] {
+		return ErrReplayedPubShare
+	}
+	if inMsgMap(a1s1, msg.senderID) {
+		return ErrDuplicatePubShare
+	}
+	if seenNonces[msg.certID] == nil {
+		seenNonces[msg.certID] = make(map[string]bool)
+	}
+	seenNonces[msg.certID][msg.nonce] = true
+	msgMap[a1s1] = append(msgMap[a1s1], msg)
+	return nil
+}
+
+/*
+ *  Finalize the certID once it got confirmed or rejected: its later msgs are
+ *  refused, its round nonces & the stored shares of its a1s1s are dropped
+ *  along with their match caches
+ */
+func FinalizeCert(certID int) {
+	a1ScanCacheLock.Lock()
+	defer a1ScanCacheLock.Unlock()
+	unmatchedPairsLock.Lock()
+	defer unmatchedPairsLock.Unlock()
+	msgLock.Lock()
+	defer msgLock.Unlock()
+
+	finalizedCerts[certID] = true
+	delete(seenNonces, certID)
+	for a1s1, msgs := range msgMap {
+		for _, msg := range msgs {
+			if msg.certID == certID {
+				delete(msgMap, a1s1)
+				delete(a1ScanCache, a1s1)
+				delete(unmatchedPairs, a1s1)
+				delete(publishedMatches, a1s1)
+				break
+			}
+		}
+	}
+}
+
+/*
+ *  List the expected committee senders without a stored share for the a1s1
+ *  Return an empty slice once every expected sender contributed
+ */
+func MissingShares(a1s1 string, expected []int) []int {
+	msgLock.RLock()
+	defer msgLock.RUnlock()
+
+	missing := []int{}
+	for _, senderId := range expected {
+		if !inMsgMap(a1s1, senderId) {
+			missing = append(missing, senderId)
+		}
+	}
+	return missing
+}
+
+/*
+ *  The committee's threshold t, the number of distinct senders' shares an a1s1
+ *  needs. The matching combines the shares pairwise, so it defaults to 2
+ */
+var quorumThreshold = 2
+var quorumThresholdLock sync.RWMutex
+
+/*
+ *  Configure the committee's threshold reported by QuorumProgress
+ */
+func SetQuorumThreshold(t int) error {
+	if t < 2 {
+		return fmt.Errorf("invalid quorum threshold %d, need 2 at least", t)
+	}
+	quorumThresholdLock.Lock()
+	defer quorumThresholdLock.Unlock()
+
+	quorumThreshold = t
+	return nil
+}
+
+/*
+ *  Report the quorum progress of the a1s1
+ *  Return the number of distinct senders with a stored share & the threshold
+ */
+func QuorumProgress(a1s1 string) (present, needed int) {
+	quorumThresholdLock.RLock()
+	needed = quorumThreshold
+	quorumThresholdLock.RUnlock()
+
+	msgLock.RLock()
+	defer msgLock.RUnlock()
+
+	senders := make(map[int]bool)
+	for _, msg := range msgMap[a1s1] {
+		senders[msg.senderID] = true
+	}
+	return len(senders), needed
+}
+
+/*
+ *  Memoized A1 scans, scoped per a1s1 & keyed by the compressed combined pub
+ *  A scope is invalidated when a new share of its a1s1 is stored & dropped
+ *  with the a1s1 by RemoveA1S1, scopes are only created for stored a1s1s
+ *  Lock order: a1ScanCacheLock, unmatchedPairsLock, msgLock; none of them is
+ *  held across a scan
+ */
+var scanPubSharesA1 = crypto.ScanPubSharesA1
+
+// The number of scans memoized per a1s1, a full scope starts over
+const maxA1ScanScope = 1024
+
+var a1ScanCache = make(map[string]map[string]*ecdsa.PublicKey)
+var a1ScanCacheLock sync.Mutex
+
+func cachedScanA1(a1s1 string, combined *ecdsa.PublicKey, S1 *ecdsa.PublicKey) *ecdsa.PublicKey {
+	key := string(keystore.ECDSAPKCompression(combined))
+
+	a1ScanCacheLock.Lock()
+	A1, ok := a1ScanCache[a1s1][key]
+	a1ScanCacheLock.Unlock()
+	if ok {
+		return A1
+	}
+	A1 = scanPubSharesA1(combined, S1)
+
+	a1ScanCacheLock.Lock()
+	defer a1ScanCacheLock.Unlock()
+
+	scope, ok := a1ScanCache[a1s1]
+	if !ok || len(scope) >= maxA1ScanScope {
+		msgLock.RLock()
+		_, stored := msgMap[a1s1]
+		msgLock.RUnlock()
+		if !stored {
+			return A1
+		}
+		scope = make(map[string]*ecdsa.PublicKey)
+		a1ScanCache[a1s1] = scope
+	}
+	scope[key] = A1
+	return A1
+}
+
+/*
+ *  The sender msg pairs of an a1s1 fully scanned without a match
+ *  Stored msgs never change, so a pair that failed once never matches later
+ *  and a new msg only needs to be tried against the stored ones; pairs are
+ *  keyed by the round nonces of their msgs
+ *  Pairs are only recorded for stored a1s1s and up to maxUnmatchedPairs per
+ *  a1s1, the pairs past it are simply scanned again
+ */
+var unmatchedPairs = make(map[string]map[string]bool)
+var unmatchedPairsLock sync.Mutex
+
+const maxUnmatchedPairs = 4096
+
+func unmatchedPairKey(a, b pubShareMsg) string {
+	if a.nonce == "" || b.nonce == "" {
+		return ""
+	}
+	return a.nonce + b.nonce
+}
+
+func isUnmatchedPair(a1s1 string, key string) bool {
+	unmatchedPairsLock.Lock()
+	defer unmatchedPairsLock.Unlock()
+
+	return key != "" && unmatchedPairs[a1s1][key]
+}
+
+func markUnmatchedPair(a1s1 string, key string) {
+	if key == "" {
+		return
+	}
+	unmatchedPairsLock.Lock()
+	defer unmatchedPairsLock.Unlock()
+
+	pairs, ok := unmatchedPairs[a1s1]
+	if !ok {
+		msgLock.RLock()
+		_, stored := msgMap[a1s1]
+		msgLock.RUnlock()
+		if !stored {
+			return
+		}
+		pairs = make(map[string]bool)
+		unmatchedPairs[a1s1] = pairs
+	}
+	if len(pairs) < maxUnmatchedPairs {
+		pairs[key] = true
+	}
+}
+
+/*
+ *  Match the msgs pair by pair in ascending sender order, skipping the pairs
+ *  already known not to match & recording the newly failed ones
+ *  Return the matching attempt, nil if none matched
+ */
+func matchNewPairs(a1s1 string, msgs []pubShareMsg, A1 *ecdsa.PublicKey, scan func(*ecdsa.PublicKey) *ecdsa.PublicKey, deadline time.Time) (*MatchAttempt, error) {
+	msgs = append([]pubShareMsg{}, msgs...)
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].senderID < msgs[j].senderID })
+
+	for i := range msgs {
+		for j := i + 1; j < len(msgs); j++ {
+			key := unmatchedPairKey(msgs[i], msgs[j])
+			if isUnmatchedPair(a1s1, key) {
+				continue
+			}
+			match, err := matchShares([]pubShareMsg{msgs[i], msgs[j]}, A1, scan, nil, deadline)
+			if err != nil || match != nil {
+				return match, err
+			}
+			markUnmatchedPair(a1s1, key)
+		}
+	}
+	return nil, nil
+}
+
 /*
  *  Check the subAccount whether get a matched main account
  *  Return the match stat
  */
 ///TODO:update late for intelligent select
 func CheckGetValidA1S1(a1s1 string) bool {
-	sbyte,_:=hexutil.Decode("0x" + a1s1)
-	A1, S1, err := keystore.GeneratePKPairFromABaddress(sbyte[:])
+	matched, _, _ := CheckGetValidA1S1Detailed(a1s1)
+	return matched
+}
+
+/*
+ *  Check the subAccount whether get a matched main account
+ *  Sender pairs are attempted in ascending (senderI, senderJ) order, so the
+ *  reported pair is the smallest one whose shares match
+ *  Return the match stat & the matched sender pair
+ */
+func CheckGetValidA1S1Detailed(a1s1 string) (matched bool, senderI int, senderJ int) {
+	match, err := checkA1S1(a1s1, time.Time{})
+	if err != nil {
+		log.Debug("Failed to check the a1s1", "err", err)
+		return false, 0, 0
+	}
+	if match != nil {
+		return true, match.Senders[0], match.Senders[1]
+	}
+	return false, 0, 0
+}
+
+/*
+ *  Check the subAccount whether get a matched main account within timeout
+ *  The scan is abandoned between two combinations once the timeout passed,
+ *  returning ErrMatchTimeout rather than a mismatch
+ *  Return the match stat
+ */
+func CheckGetValidA1S1WithTimeout(a1s1 string, timeout time.Duration) (bool, error) {
+	match, err := checkA1S1(a1s1, time.Now().Add(timeout))
+	if err != nil {
+		return false, err
+	}
+	return match != nil, nil
+}
+
+/*
+ *  Match the stored shares of the a1s1, giving up at the deadline if not zero
+ *  Return the matching attempt, nil if none matched
+ */
+func checkA1S1(a1s1 string, deadline time.Time) (*MatchAttempt, error) {
+	sbyte, err := hexutil.Decode("0x" + a1s1)
+	if err != nil {
+		return nil, err
+	}
+	A1, S1, err := keystore.ParseABaddress(sbyte)
 	if err !=nil {
 		log.Error("A1S1 decode failed!", err)
-		return false
+		return nil, err
 	}
 
 	//scan the main account, to find whether get a matched account
+	scan := func(bA *ecdsa.PublicKey) *ecdsa.PublicKey {
+		return cachedScanA1(a1s1, bA, S1)
+	}
+	msgs := storedShares(a1s1)
+	match, err := matchNewPairs(a1s1, msgs, A1, scan, deadline)
+	if err != nil {
+		return nil, err
+	}
+	if match != nil {
+		log.Debug("Get a matched account!", "senders", match.Senders)
+		ev := MatchEvent{A1S1: a1s1, Senders: match.Senders}
+		for _, msg := range msgs {
+			if msg.senderID == match.Senders[0] {
+				ev.CertID = msg.certID
+				break
+			}
+		}
+		if markMatchPublished(a1s1) {
+			publishMatch(ev)
+		}
+	} else {
+		log.Debug("Failed to get a matched account")
+	}
+	return match, nil
+}
+
+/*
+ *  The event sent to the match subscribers when the shares of an a1s1 match
+ */
+type MatchEvent struct {
+	A1S1    string
+	CertID  int
+	Senders [2]int
+}
+
+// The number of match events queued per subscriber, the events past it are
+// dropped
+var matchQueueSize = 64
+
+var (
+	matchQueues     = make(map[chan MatchEvent]struct{})
+	matchQueuesLock sync.Mutex
+	matchScope      event.SubscriptionScope
+
+	droppedMatchEvents uint64
+)
+
+/*
+ *  Subscribe to the matches found by the match checks
+ *  The events are queued per subscriber & delivered off the match path, a
+ *  subscriber falling matchQueueSize events behind loses the new ones
+ */
+func SubscribeMatches(ch chan<- MatchEvent) event.Subscription {
+	queue := make(chan MatchEvent, matchQueueSize)
+	matchQueuesLock.Lock()
+	matchQueues[queue] = struct{}{}
+	matchQueuesLock.Unlock()
+
+	return matchScope.Track(event.NewSubscription(func(quit <-chan struct{}) error {
+		defer func() {
+			matchQueuesLock.Lock()
+			delete(matchQueues, queue)
+			matchQueuesLock.Unlock()
+		}()
+		for {
+			select {
+			case ev := <-queue:
+				select {
+				case ch <- ev:
+				case <-quit:
+					return nil
+				}
+			case <-quit:
+				return nil
+			}
+		}
+	}))
+}
+
+/*
+ *  The stored a1s1s whose match got published, guarded by msgLock
+ *  Each match is published once, later checks of the a1s1 find it silently
+ */
+var publishedMatches = make(map[string]bool)
+
+// markMatchPublished records the a1s1 as published, reporting whether it's the
+// first time; a1s1s no longer stored aren't published
+func markMatchPublished(a1s1 string) bool {
+	msgLock.Lock()
+	defer msgLock.Unlock()
+
+	if _, stored := msgMap[a1s1]; !stored || publishedMatches[a1s1] {
+		return false
+	}
+	publishedMatches[a1s1] = true
+	return true
+}
+
+// publishMatch queues the event to every subscriber without blocking
+func publishMatch(ev MatchEvent) {
+	matchQueuesLock.Lock()
+	defer matchQueuesLock.Unlock()
+
+	for queue := range matchQueues {
+		select {
+		case queue <- ev:
+		default:
+			atomic.AddUint64(&droppedMatchEvents, 1)
+		}
+	}
+}
+
+/*
+ *  The number of match events dropped for subscribers lagging behind
+ */
+func DroppedMatchEvents() uint64 {
+	return atomic.LoadUint64(&droppedMatchEvents)
+}
+
+/*
+ *  A single combination tried while matching an a1s1
+ *  Senders & Shares are the sender IDs and the indexes of the pub shares
+ *  within their msgs, Combined the hex encoded combined pub
+ */
+type MatchAttempt struct {
+	Senders  [2]int
+	Shares   [2]int
+	Combined string
+	Err      error
+	Matched  bool
+}
+
+/*
+ *  The structured trace of a match attempt over the stored shares of an a1s1
+ */
+type MatchTrace struct {
+	A1S1     string
+	Senders  []int
+	Attempts []MatchAttempt
+	Matched  bool
+}
+
+/*
+ *  Trace the match attempt of the a1s1 over the current msg store
+ *  Read only, neither the msg store nor the scan cache are modified
+ */
+func TraceA1S1(a1s1 string) (*MatchTrace, error) {
+	sbyte, err := hexutil.Decode("0x" + a1s1)
+	if err != nil {
+		return nil, err
+	}
+	A1, S1, err := keystore.ParseABaddress(sbyte)
+	if err != nil {
+		return nil, err
+	}
+	trace := &MatchTrace{A1S1: a1s1}
+	msgs := storedShares(a1s1)
+	for _, msg := range msgs {
+		trace.Senders = append(trace.Senders, msg.senderID)
+	}
+	scan := func(bA *ecdsa.PublicKey) *ecdsa.PublicKey {
+		return scanPubSharesA1(bA, S1)
+	}
+	record := func(attempt MatchAttempt) {
+		trace.Attempts = append(trace.Attempts, attempt)
+	}
+	match, err := matchShares(msgs, A1, scan, record, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	trace.Matched = match != nil
+	return trace, nil
+}
+
+// The pub shares combination, a variable so tests can slow the scan down
+var combinePubs = sssa.CombineECDSAPubs
+
+/*
+ *  Combine every pair of pub shares from two different senders & scan the
+ *  combined pub, until the scanned A1 matches
+ *  Pairs are attempted in ascending (senderI, senderJ) order, the shares of a
+ *  pair in ascending index order; visit, if not nil, gets each attempt
+ *  A non zero deadline stops the scan with ErrMatchTimeout once passed
+ *  Return the matching attempt, nil if none matched
+ */
+func matchShares(msgs []pubShareMsg, A1 *ecdsa.PublicKey, scan func(*ecdsa.PublicKey) *ecdsa.PublicKey, visit func(MatchAttempt), deadline time.Time) (*MatchAttempt, error) {
+	msgs = append([]pubShareMsg{}, msgs...)
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].senderID < msgs[j].senderID })
+
 	var tmpSet []string = make([]string, 2)
-	for i := range MsgMap[a1s1] {
-		for j := range MsgMap[a1s1] {
+	for i := range msgs {
+		for j := range msgs {
 			if i < j {
-				err, pubSet01 := extractPubshare(MsgMap[a1s1][i])
-				if err == false {
-					return false
+				ok, pubSet01 := extractPubshare(msgs[i].shares)
+				if !ok {
+					return nil, errors.New("pub shares msg format error")
 				}
 
-				err, pubSet02 := extractPubshare(MsgMap[a1s1][j])
-				if err == false {
-					return false
+				ok, pubSet02 := extractPubshare(msgs[j].shares)
+				if !ok {
+					return nil, errors.New("pub shares msg format error")
 				}
 
 				for m := range pubSet01 {
 					for n := range pubSet02 {
+						if !deadline.IsZero() && time.Now().After(deadline) {
+							return nil, ErrMatchTimeout
+						}
 						tmpSet[0] = pubSet01[m]
 						tmpSet[1] = pubSet02[n]
 
-						//fmt.Println("tmp:", tmpSet)
-						combined, err := sssa.CombineECDSAPubs(tmpSet)
+						attempt := MatchAttempt{Senders: [2]int{msgs[i].senderID, msgs[j].senderID}, Shares: [2]int{m, n}}
+						combined, err := combinePubs(tmpSet)
 						if err != nil {
 							log.Debug("Fatal: combining: ", err)
-							continue
+							attempt.Err = err
+						} else {
+							attempt.Combined = hex.EncodeToString([]byte(combined))
+							bA := crypto.ToECDSAPub([]byte(combined))
+							if bA == nil || bA.X == nil {
+								attempt.Err = errors.New("combined pub is not a valid point")
+							} else {
+								A1Check := scan(bA)
+								attempt.Matched = A1.X.Cmp(A1Check.X) == 0 && A1.Y.Cmp(A1Check.Y) == 0
+							}
 						}
-						bA := crypto.ToECDSAPub([]byte(combined))
-						A1Check := crypto.ScanPubSharesA1(bA, S1)
-
-						if A1.X.Cmp(A1Check.X) == 0 && A1.Y.Cmp(A1Check.Y) == 0 {
-							log.Debug("Get a matched account!")
-							return true
+						if visit != nil {
+							visit(attempt)
+						}
+						if attempt.Matched {
+							return &attempt, nil
 						}
 					}
 				}
 			}
 		}
 	}
-	log.Debug("Failed to get a matched account")
-	return false
+	return nil, nil
 }
 
 /*
@@ -230,11 +982,77 @@ func SendCommitteeMsg(ethereum *eth.Ethereum, msg string) bool {
 }
 
 
+// The authentication contract's confirm method, confirmCert(certID, approved)
+const confirmCertSignature = "confirmCert(uint256,bool)"
+
+var confirmSel = methodSelector(confirmCertSignature)
+
+/*
+ * The committee's decision on a cert, encoded as the confirm method's bool
+ * ConfirmPending is the state of a cert awaiting the decision, the bool of
+ * confirmCert(uint256,bool) can't carry it, so it's never sent
+ */
+type ConfirmStatus int
+
+const (
+	ConfirmRejected ConfirmStatus = 0
+	ConfirmApproved ConfirmStatus = 1
+	ConfirmPending  ConfirmStatus = 2
+)
+
+func (s ConfirmStatus) String() string {
+	switch s {
+	case ConfirmRejected:
+		return "rejected"
+	case ConfirmApproved:
+		return "approved"
+	case ConfirmPending:
+		return "pending"
+	}
+	return fmt.Sprintf("ConfirmStatus(%d)", int(s))
+}
+
+/*
+ * The 4 bytes ABI selector of the contract method signature
+ */
+func methodSelector(signature string) [4]byte {
+	var sel [4]byte
+	copy(sel[:], crypto.Keccak256([]byte(signature))[:4])
+	return sel
+}
+
+/*
+ * The selector of the authentication contract's confirm method
+ */
+func confirmSelector() [4]byte {
+	return confirmSel
+}
+
+/*
+ * Encode the calldata of the confirm method, refusing the pending & unknown statuses
+ */
+func encodeConfirmMsg(certID int, confirmStat ConfirmStatus) ([]byte, error) {
+	if confirmStat == ConfirmPending {
+		return nil, errors.New("pending confirm status can't be sent to the contract")
+	}
+	if confirmStat != ConfirmRejected && confirmStat != ConfirmApproved {
+		return nil, fmt.Errorf("unknown confirm status %d", int(confirmStat))
+	}
+	sel := confirmSelector()
+	msgStr := hexutil.Encode(sel[:]) + state.FormatData64bytes(strconv.Itoa(certID)) + state.FormatData64bytes(strconv.Itoa(int(confirmStat)))
+	return hexutil.Decode(msgStr)
+}
+
 /*
  * After verified the account, send a confirm tx to authentication contract
  * Return the tx sending stat
  */
-func SendAccountConfirmMsg(ethereum *eth.Ethereum, certID int, confirmStat int) bool {
+func SendAccountConfirmMsg(ethereum *eth.Ethereum, certID int, confirmStat ConfirmStatus) bool {
+	msg, err := encodeConfirmMsg(certID, confirmStat)
+	if err != nil {
+		log.Error("Invalid committee confirm msg", "certID", certID, "err", err)
+		return false
+	}
 	// Look up the wallet containing the requested signer
 	coinbase, err := ethereum.Etherbase()
 	if err != nil {
@@ -248,9 +1066,6 @@ func SendAccountConfirmMsg(ethereum *eth.Ethereum, certID int, confirmStat int)
 		return false
 	}
 
-	msgStr := "0xc03c1796" + state.FormatData64bytes(strconv.Itoa(certID)) + state.FormatData64bytes(strconv.Itoa(confirmStat))
-	msg, err := hexutil.Decode(msgStr)
-
 	//new a transaction
 	pendingStat := ethereum.TxPool().State()
 	tx := types.NewTransaction(pendingStat.GetNonce(coinbase), common.HexToAddress(common.AuthenticationContractAddressString), nil, 60000000, nil, msg)
@@ -261,6 +1076,7 @@ func SendAccountConfirmMsg(ethereum *eth.Ethereum, certID int, confirmStat int)
 	ethereum.TxPool().AddLocal(signedTx)
 
 	log.Info("Submitted transaction", "fullhash", signedTx.Hash().Hex(), "recipient", tx.To())
+	FinalizeCert(certID)
 	return true
 }
 
@@ -268,62 +1084,109 @@ func SendAccountConfirmMsg(ethereum *eth.Ethereum, certID int, confirmStat int)
 /*
  * Read the uncomfirmAddresses from the authentication contract
  * Return the certID, ringSig, pubSkey, checkCertID
+ * Deprecated: the certID watermark skips or reprocesses the certs of a list
+ * whose entries got removed or reordered, use ReadPendingCerts
  */
 func ReadUnconfirmedAddress(usechain *eth.Ethereum, index int64, contractAddr common.Address, checkCertID int64) (string, string, string, int64){
 	// generate i's keyindex to check unconfirmed address index
-	keyIndex, _ := state.ExpandToIndex(state.UnConfirmedAddress, "", index)
-	resultUnConfirmedAddressIndex := usechain.TxPool().State().GetState(contractAddr, common.HexToHash(keyIndex))
+	keyIndex, _ := UnconfirmedAddressStorageKey(index)
+	resultUnConfirmedAddressIndex := usechain.TxPool().State().GetState(contractAddr, keyIndex)
 	unConfirmedAddressIndex := state.GetLen(resultUnConfirmedAddressIndex[:])
-	//fmt.Println("unconfirmed address index: %x\n", resultUnConfirmedAddressIndex.String())
 
 	// check added
 	if  checkCertID >= unConfirmedAddressIndex {
 		return resultUnConfirmedAddressIndex.String(),"","", 0
 	}
 
-	// generate unConfirmedAddress indexed key
-	newKeyIndex, _ := state.ExpandToIndex(state.CertToAddress, hex.EncodeToString(resultUnConfirmedAddressIndex[:]), 0)
-	resultUnConfirmedAddress := usechain.TxPool().State().GetState(contractAddr, common.HexToHash(newKeyIndex))
-	resultUnConfirmedAddr := hex.EncodeToString(resultUnConfirmedAddress[:])
-	//fmt.Println("resultUnConfirmedAddress: ", "00"+resultUnConfirmedAddr[:len(resultUnConfirmedAddr)-2])
-
-	// ++++++++++++++++++++++++++++++++++++++++++++
-	// get ringSig
-	resultRingSig, _ := state.ExpandToIndex(state.CertificateAddr, "00"+resultUnConfirmedAddr[:len(resultUnConfirmedAddr)-2], 1)
-	addressRingSig := usechain.TxPool().State().GetState(contractAddr, common.HexToHash(resultRingSig))
-	addressRingSigLen := state.GetLen(addressRingSig[:])
-	forLen := addressRingSigLen / (int64(common.HashLength) * 2)
-	// init query data hash
-	var buff bytes.Buffer
-	res := ""
-	for j := int64(0); j <= forLen; j++ {
-		newKeyIndexHash := state.CalculateStateDbIndex(resultRingSig, "")
-		newKeyIndexString := state.IncreaseHexByNum(newKeyIndexHash, j)
-		result := usechain.TxPool().State().GetState(contractAddr, common.HexToHash(newKeyIndexString))
-		buff.Write(result[:])
+	cert := readUnconfirmedCert(usechain.TxPool().State(), contractAddr, resultUnConfirmedAddressIndex)
+	if cert.Err != nil {
+		log.Warn("Failed to read the unconfirmed cert", "certID", cert.CertID, "err", cert.Err)
+		return cert.CertID, "", "", unConfirmedAddressIndex
 	}
-	res += buff.String()[:addressRingSigLen/2]
-	//fmt.Println("addressRingSig: ", res)
-
-	// ++++++++++++++++++++++++++++++++++++++++++++
-	// get pubSkey
-	resultPubSKey, _ := state.ExpandToIndex(state.CertificateAddr, "00"+resultUnConfirmedAddr[:len(resultUnConfirmedAddr)-2], 2)
-	addressPubSKey := usechain.TxPool().State().GetState(contractAddr, common.HexToHash(resultPubSKey))
-
-	addressPubSKeyLen := state.GetLen(addressPubSKey[:])
-	forLen1 := addressPubSKeyLen / (int64(common.HashLength) * 2)
-	var buff1 bytes.Buffer
-	res1 := ""
-	for j := int64(0); j <= forLen1; j++ {
-		newKeyIndexHash := state.CalculateStateDbIndex(resultPubSKey, "")
-		newKeyIndexString := state.IncreaseHexByNum(newKeyIndexHash, j)
-		result := usechain.TxPool().State().GetState(contractAddr, common.HexToHash(newKeyIndexString))
-		buff1.Write(result[:])
-	}
-	res1 += buff1.String()[:addressPubSKeyLen/2]
-	//fmt.Println("addressPubSKey: ", res1)
 	checkCertID = unConfirmedAddressIndex
-	return resultUnConfirmedAddressIndex.String(), res, res1, checkCertID
+	return cert.CertID, cert.RingSig, cert.PubSKey, checkCertID
 }
 
+/*
+ * An unconfirmed cert read from the authentication contract
+ * Err is set when its fields couldn't be read
+ */
+type UnconfirmedCert struct {
+	CertID  string
+	RingSig string
+	PubSKey string
+	Err     error
+}
+
+/*
+ * Read the certs of the first n slots of the unconfirmed list the cursor
+ * didn't process yet, empty & duplicated slots are skipped
+ * The whole list is read every cycle, so removed or reordered entries
+ * neither hide nor repeat a cert; the caller marks the certs it handled
+ */
+func ReadPendingCerts(usechain *eth.Ethereum, contractAddr common.Address, cursor *CertCursor, n int64) []UnconfirmedCert {
+	return readPendingCerts(usechain.TxPool().State(), contractAddr, cursor, n)
+}
 
+func readPendingCerts(reader stateReader, contractAddr common.Address, cursor *CertCursor, n int64) []UnconfirmedCert {
+	certIDs := make([]string, 0, n)
+	for i := int64(0); i < n; i++ {
+		key, err := UnconfirmedAddressStorageKey(i)
+		if err != nil {
+			log.Warn("Failed to compute the unconfirmed list slot", "index", i, "err", err)
+			continue
+		}
+		certIDs = append(certIDs, reader.GetState(contractAddr, key).Hex())
+	}
+	certs := []UnconfirmedCert{}
+	for _, certID := range cursor.Pending(certIDs) {
+		certs = append(certs, readUnconfirmedCert(reader, contractAddr, common.HexToHash(certID)))
+	}
+	return certs
+}
+
+// readUnconfirmedCert reads the ringSig & pubSkey of the certID word
+func readUnconfirmedCert(reader stateReader, contractAddr common.Address, certID common.Hash) UnconfirmedCert {
+	cert := UnconfirmedCert{CertID: certID.String()}
+
+	key, err := certToAddressKey(certID)
+	if err != nil {
+		cert.Err = err
+		return cert
+	}
+	certAddr := reader.GetState(contractAddr, key)
+
+	if cert.RingSig, err = readCertField(reader, contractAddr, certAddr, certRingSigField); err != nil {
+		cert.Err = fmt.Errorf("ring sig: %v", err)
+		return cert
+	}
+	if cert.PubSKey, err = readCertField(reader, contractAddr, certAddr, certPubSKeyField); err != nil {
+		cert.RingSig = ""
+		cert.Err = fmt.Errorf("pubSkey: %v", err)
+	}
+	return cert
+}
+
+/*
+ * Read a variable length field of a certificate entry, the ringSig or pubSkey
+ * The on-chain length is bounded by MaxDynamicBytes before anything is read
+ */
+func readCertField(reader stateReader, contractAddr common.Address, certAddr common.Hash, field int64) (string, error) {
+	lenKey, err := certFieldLenKey(certAddr, field)
+	if err != nil {
+		return "", err
+	}
+	fieldLen := reader.GetState(contractAddr, common.HexToHash(lenKey))
+	length := state.GetLen(fieldLen[:])
+
+	_, dataKeys, err := certFieldKeys(certAddr, field, length)
+	if err != nil {
+		return "", err
+	}
+	var buff bytes.Buffer
+	for _, key := range dataKeys {
+		result := reader.GetState(contractAddr, key)
+		buff.Write(result[:])
+	}
+	return buff.String()[:length/2], nil
+}
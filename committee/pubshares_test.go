@@ -0,0 +1,835 @@
+// Copyright 2018 The go-usechain Authors
+// This file is part of the go-usechain library.
+//
+// The go-usechain library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-usechain library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-usechain library. If not, see <http://www.gnu.org/licenses/>.
+
+package committee
+
+import (
+	"crypto/ecdsa"
+	"encoding/hex"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/usechain/go-usechain/accounts/keystore"
+	"github.com/usechain/go-usechain/commitee/sssa"
+	"github.com/usechain/go-usechain/common/math"
+	"github.com/usechain/go-usechain/crypto"
+)
+
+// testPubShares builds a pub-share body of n random points tagged with the
+// sender's share ID, in the layout produced by GeneratePubShare.
+func testPubShares(t testing.TB, sender int64, n int) string {
+	shares := ""
+	for i := 0; i < n; i++ {
+		priv, err := crypto.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		shares += sssa.ToBase64(big.NewInt(sender)) + sssa.ToBase64(priv.X) + sssa.ToBase64(priv.Y)
+	}
+	return shares
+}
+
+// testA1S1 returns the hex encoded AB address built from two random keys.
+func testA1S1(t testing.TB) string {
+	A, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	S, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ab := append(keystore.ECDSAPKCompression(&A.PublicKey), keystore.ECDSAPKCompression(&S.PublicKey)...)
+	return hex.EncodeToString(ab)
+}
+
+// testMatchingA1S1 returns a one-point pub-share body for each of the given
+// senders together with an a1s1 whose A1 is matched by combining them.
+func testMatchingA1S1(t testing.TB, senders ...int64) (string, []string) {
+	bodies := make([]string, len(senders))
+	for i, sender := range senders {
+		bodies[i] = testPubShares(t, sender, 1)
+	}
+	combined, err := sssa.CombineECDSAPubs(bodies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	S, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	A1 := crypto.ScanPubSharesA1(crypto.ToECDSAPub([]byte(combined)), &S.PublicKey)
+	ab := append(keystore.ECDSAPKCompression(A1), keystore.ECDSAPKCompression(&S.PublicKey)...)
+	return hex.EncodeToString(ab), bodies
+}
+
+// testThresholdA1S1 deals 2-of-n shares t_i = t + c*i of a random secret t to
+// the given senders and returns the a1s1 matched by t*A, with each sender's
+// one-point pub-share body t_i*A.
+func testThresholdA1S1(t testing.TB, senders ...int64) (string, map[int64]string) {
+	N := crypto.S256().Params().N
+	keys := make([]*ecdsa.PrivateKey, 4)
+	for i := range keys {
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = key
+	}
+	secret, coeff, A, S := keys[0].D, keys[1].D, keys[2], keys[3]
+
+	bodies := make(map[int64]string)
+	for _, sender := range senders {
+		share := new(big.Int).Mul(coeff, big.NewInt(sender))
+		share.Add(share, secret).Mod(share, N)
+		x, y := crypto.S256().ScalarMult(A.X, A.Y, share.Bytes())
+		bodies[sender] = sssa.ToBase64(big.NewInt(sender)) + sssa.ToBase64(x) + sssa.ToBase64(y)
+	}
+	x, y := crypto.S256().ScalarMult(A.X, A.Y, secret.Bytes())
+	A1 := crypto.ScanPubSharesA1(&ecdsa.PublicKey{Curve: crypto.S256(), X: x, Y: y}, &S.PublicKey)
+	ab := append(keystore.ECDSAPKCompression(A1), keystore.ECDSAPKCompression(&S.PublicKey)...)
+	return hex.EncodeToString(ab), bodies
+}
+
+// testPubShareMsg wraps a pub-share body into a full PubSharesMsg with a fresh
+// round nonce.
+func testPubShareMsg(a1s1 string, certID int, senderID int, body string) string {
+	nonce, err := NewRoundNonce()
+	if err != nil {
+		panic(err)
+	}
+	return testPubShareMsgWithNonce(a1s1, certID, senderID, body, nonce)
+}
+
+func testPubShareMsgWithNonce(a1s1 string, certID int, senderID int, body string, nonce string) string {
+	return BuildPubShareMsg(a1s1, certID, senderID, sssa.FormatData44bytes(strconv.Itoa(len(body)/132))+body, nonce)
+}
+
+func TestRegisterPubShareMsg(t *testing.T) {
+	a1s1, bodies := testMatchingA1S1(t, 1, 2)
+	defer delete(msgMap, a1s1)
+
+	got, matched, err := RegisterPubShareMsg(testPubShareMsg(a1s1, 7, 1, bodies[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != a1s1 {
+		t.Errorf("a1s1 mismatch: have %s, want %s", got, a1s1)
+	}
+	if matched {
+		t.Error("matched with a single share")
+	}
+	if _, _, err := RegisterPubShareMsg(testPubShareMsg(a1s1, 7, 1, bodies[0])); err != ErrDuplicatePubShare {
+		t.Errorf("duplicate sender: have %v, want %v", err, ErrDuplicatePubShare)
+	}
+	if _, matched, err = RegisterPubShareMsg(testPubShareMsg(a1s1, 7, 2, bodies[1])); err != nil {
+		t.Fatal(err)
+	}
+	if !matched {
+		t.Error("no match after the second sender's share")
+	}
+	if _, _, err := RegisterPubShareMsg("0x" + a1s1); err == nil {
+		t.Error("expected error for a truncated msg")
+	}
+}
+
+func TestPubShareReplay(t *testing.T) {
+	a1s1 := testA1S1(t)
+	defer delete(msgMap, a1s1)
+	defer delete(seenNonces, 8)
+
+	nonce, err := NewRoundNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := testPubShareMsgWithNonce(a1s1, 8, 1, testPubShares(t, 1, 1), nonce)
+	if _, _, _, _, got, err := ExtractPubShareMsg(msg); err != nil || got != nonce {
+		t.Fatalf("extracted nonce mismatch: have %q (%v), want %q", got, err, nonce)
+	}
+	if _, _, err := RegisterPubShareMsg(msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := RegisterPubShareMsg(msg); err != ErrReplayedPubShare {
+		t.Errorf("replayed msg: have %v, want %v", err, ErrReplayedPubShare)
+	}
+	if _, _, err := RegisterPubShareMsg(testPubShareMsg(a1s1, 8, 2, testPubShares(t, 2, 1))); err != nil {
+		t.Errorf("fresh nonce rejected: %v", err)
+	}
+	// The captured msg with its nonce stripped
+	stripped := msg[:len(msg)-44]
+	if _, _, err := RegisterPubShareMsg(stripped); err != ErrMissingNonce {
+		t.Errorf("stripped nonce: have %v, want %v", err, ErrMissingNonce)
+	}
+	msgLock.Lock()
+	err = addPubShareMsg(a1s1, pubShareMsg{certID: 8, senderID: 3, shares: testPubShares(t, 3, 1)})
+	msgLock.Unlock()
+	if err != ErrMissingNonce {
+		t.Errorf("stored nonce-less msg: have %v, want %v", err, ErrMissingNonce)
+	}
+}
+
+func TestFinalizeCert(t *testing.T) {
+	a1s1, other := testA1S1(t), testA1S1(t)
+	defer RemoveA1S1(a1s1)
+	defer RemoveA1S1(other)
+	defer delete(finalizedCerts, 23)
+	defer delete(seenNonces, 24)
+
+	nonce, err := NewRoundNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := testPubShareMsgWithNonce(a1s1, 23, 1, testPubShares(t, 1, 1), nonce)
+	if _, _, err := RegisterPubShareMsg(msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := RegisterPubShareMsg(testPubShareMsg(other, 24, 1, testPubShares(t, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	FinalizeCert(23)
+
+	if _, ok := msgMap[a1s1]; ok {
+		t.Error("shares of the finalized cert kept")
+	}
+	if len(seenNonces[24]) != 1 || len(msgMap[other]) != 1 {
+		t.Error("another cert got finalized")
+	}
+	// Replays in a later round, as well as fresh msgs, are refused
+	if _, _, err := RegisterPubShareMsg(msg); err != ErrFinalizedCert {
+		t.Errorf("replay after finalizing: have %v, want %v", err, ErrFinalizedCert)
+	}
+	if _, _, err := RegisterPubShareMsg(testPubShareMsg(a1s1, 23, 2, testPubShares(t, 2, 1))); err != ErrFinalizedCert {
+		t.Errorf("fresh msg after finalizing: have %v, want %v", err, ErrFinalizedCert)
+	}
+}
+
+func TestMissingShares(t *testing.T) {
+	a1s1 := testA1S1(t)
+	defer delete(msgMap, a1s1)
+
+	for _, sender := range []int{1, 3} {
+		body := testPubShares(t, int64(sender), 1)
+		if _, _, err := RegisterPubShareMsg(testPubShareMsg(a1s1, 7, sender, body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if missing := MissingShares(a1s1, []int{1, 2, 3, 4}); !reflect.DeepEqual(missing, []int{2, 4}) {
+		t.Errorf("missing senders mismatch: have %v, want [2 4]", missing)
+	}
+	if missing := MissingShares(a1s1, []int{1, 3}); missing == nil || len(missing) != 0 {
+		t.Errorf("satisfied quorum: have %v, want empty slice", missing)
+	}
+}
+
+func TestQuorumProgress(t *testing.T) {
+	defer SetQuorumThreshold(2)
+	if err := SetQuorumThreshold(3); err != nil {
+		t.Fatal(err)
+	}
+	a1s1 := testA1S1(t)
+	defer delete(msgMap, a1s1)
+
+	if present, needed := QuorumProgress(a1s1); present != 0 || needed != 3 {
+		t.Errorf("unknown a1s1: have (%d, %d), want (0, 3)", present, needed)
+	}
+	for _, sender := range []int{1, 3} {
+		body := testPubShares(t, int64(sender), 1)
+		if _, _, err := RegisterPubShareMsg(testPubShareMsg(a1s1, 7, sender, body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if present, needed := QuorumProgress(a1s1); present != 2 || needed != 3 {
+		t.Errorf("quorum progress mismatch: have (%d, %d), want (2, 3)", present, needed)
+	}
+	if err := SetQuorumThreshold(1); err == nil {
+		t.Error("accepted a threshold below 2")
+	}
+}
+
+func TestCommitteeShareRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "committee-share")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "share.json")
+
+	priv, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	member := &CommitteeMember{ID: sssa.ToBase64(big.NewInt(2)), Share: priv.D}
+	// The share files keep the layout of the base64 string encoding
+	for _, share := range []*big.Int{priv.D, big.NewInt(1)} {
+		m := &CommitteeMember{ID: member.ID, Share: share}
+		if have, want := string(encodeCommitteeShare(m)), m.ID+sssa.ToBase64(share); have != want {
+			t.Errorf("share encoding mismatch: have %s, want %s", have, want)
+		}
+	}
+	if err := StoreCommitteeShare(path, member, "foo", keystore.LightScryptN, keystore.LightScryptP); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCommitteeShare(path, "bar"); err == nil {
+		t.Error("loaded the share with a wrong passphrase")
+	}
+	loaded, err := LoadCommitteeShare(path, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.ID != member.ID || loaded.Share.Cmp(member.Share) != 0 {
+		t.Fatalf("share mismatch: have %s/%x, want %s/%x", loaded.ID, loaded.Share, member.ID, member.Share)
+	}
+	A, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubSet := []*ecdsa.PublicKey{&A.PublicKey}
+	if have, want := loaded.GeneratePubShare(pubSet), member.GeneratePubShare(pubSet); have != want {
+		t.Errorf("pub share mismatch: have %s, want %s", have, want)
+	}
+}
+
+func TestTraceA1S1(t *testing.T) {
+	a1s1 := testA1S1(t)
+	defer delete(msgMap, a1s1)
+	msgMap[a1s1] = []pubShareMsg{
+		{senderID: 1, shares: testPubShares(t, 1, 2)},
+		{senderID: 2, shares: testPubShares(t, 2, 2)},
+		{senderID: 3, shares: testPubShares(t, 3, 2)},
+	}
+	trace, err := TraceA1S1(a1s1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trace.Matched {
+		t.Error("matched random shares")
+	}
+	// 3 sender pairs, 2x2 share combinations each
+	attempted := make(map[[4]int]bool)
+	for _, a := range trace.Attempts {
+		if a.Err != nil || a.Combined == "" || a.Matched {
+			t.Errorf("unexpected attempt %+v", a)
+		}
+		attempted[[4]int{a.Senders[0], a.Senders[1], a.Shares[0], a.Shares[1]}] = true
+	}
+	if len(trace.Attempts) != 12 || len(attempted) != 12 {
+		t.Errorf("attempt count mismatch: have %d (%d distinct), want 12", len(trace.Attempts), len(attempted))
+	}
+	if _, ok := a1ScanCache[a1s1]; ok {
+		t.Error("trace populated the scan cache")
+	}
+
+	matching, bodies := testMatchingA1S1(t, 1, 2)
+	defer delete(msgMap, matching)
+	msgMap[matching] = []pubShareMsg{{senderID: 1, shares: bodies[0]}, {senderID: 2, shares: bodies[1]}}
+	if trace, err = TraceA1S1(matching); err != nil {
+		t.Fatal(err)
+	}
+	if !trace.Matched || len(trace.Attempts) != 1 || !trace.Attempts[0].Matched {
+		t.Errorf("matching trace mismatch: %+v", trace)
+	}
+}
+
+func TestCheckGetValidA1S1Detailed(t *testing.T) {
+	a1s1, bodies := testThresholdA1S1(t, 1, 2, 3)
+	defer delete(msgMap, a1s1)
+
+	// Every pair matches, the smallest one is reported whatever the store order
+	msgMap[a1s1] = []pubShareMsg{
+		{senderID: 3, shares: bodies[3]},
+		{senderID: 1, shares: bodies[1]},
+		{senderID: 2, shares: bodies[2]},
+	}
+	if matched, i, j := CheckGetValidA1S1Detailed(a1s1); !matched || i != 1 || j != 2 {
+		t.Errorf("matched pair mismatch: have %v (%d, %d), want true (1, 2)", matched, i, j)
+	}
+	// Sender 1 contributes a bogus share, only (2, 3) is valid
+	msgMap[a1s1][1].shares = testPubShares(t, 1, 1)
+	if matched, i, j := CheckGetValidA1S1Detailed(a1s1); !matched || i != 2 || j != 3 {
+		t.Errorf("matched pair mismatch: have %v (%d, %d), want true (2, 3)", matched, i, j)
+	}
+}
+
+func TestConfirmSelector(t *testing.T) {
+	if sel, want := confirmSelector(), [4]byte{0xc0, 0x3c, 0x17, 0x96}; sel != want {
+		t.Errorf("confirm selector mismatch: have %x, want %x", sel, want)
+	}
+}
+
+func TestEncodeConfirmMsg(t *testing.T) {
+	for status, want := range map[ConfirmStatus]int64{ConfirmRejected: 0, ConfirmApproved: 1} {
+		msg, err := encodeConfirmMsg(21, status)
+		if err != nil {
+			t.Fatalf("%v: %v", status, err)
+		}
+		if len(msg) != 4+2*32 {
+			t.Fatalf("%v: calldata length %d, want %d", status, len(msg), 4+2*32)
+		}
+		if have := new(big.Int).SetBytes(msg[4+32:]); have.Int64() != want {
+			t.Errorf("%v: encoded status %v, want %d", status, have, want)
+		}
+	}
+	if _, err := encodeConfirmMsg(21, ConfirmPending); err == nil {
+		t.Error("pending status encoded")
+	}
+	for _, status := range []ConfirmStatus{-1, 3} {
+		if _, err := encodeConfirmMsg(21, status); err == nil {
+			t.Errorf("unknown status %d encoded", int(status))
+		}
+	}
+}
+
+func TestShareHexConversion(t *testing.T) {
+	share := big.NewInt(0).Lsh(big.NewInt(0xdeadbeef), 200)
+	b64 := sssa.ToBase64(share)
+
+	hexStr, err := ShareToHex(b64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := hex.EncodeToString(math.PaddedBigBytes(share, 32)); hexStr != want {
+		t.Errorf("hex mismatch: have %s, want %s", hexStr, want)
+	}
+	for _, in := range []string{hexStr, "0x" + hexStr} {
+		back, err := ShareFromHex(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if back != b64 || sssa.FromBase64(back).Cmp(share) != 0 {
+			t.Errorf("round trip of %s mismatch: have %s, want %s", in, back, b64)
+		}
+	}
+	for _, bad := range []string{"", b64[:43], b64[:43] + "*", b64 + "A"} {
+		if _, err := ShareToHex(bad); err == nil {
+			t.Errorf("ShareToHex accepted %q", bad)
+		}
+	}
+	for _, bad := range []string{"", hexStr[:62], hexStr[:63] + "g", "0x" + hexStr + "00"} {
+		if _, err := ShareFromHex(bad); err == nil {
+			t.Errorf("ShareFromHex accepted %q", bad)
+		}
+	}
+}
+
+func BenchmarkCheckGetValidA1S1(b *testing.B)       { benchmarkCheckGetValidA1S1(b, false) }
+func BenchmarkCheckGetValidA1S1Cached(b *testing.B) { benchmarkCheckGetValidA1S1(b, true) }
+
+// benchmarkCheckGetValidA1S1 runs two consecutive match attempts over the same
+// legacy, nonce-less shares, which the pair cache can't cover, and reports the
+// number of elliptic-curve scans performed per iteration.
+func benchmarkCheckGetValidA1S1(b *testing.B, cached bool) {
+	scans := 0
+	scanPubSharesA1 = func(bA *ecdsa.PublicKey, S1 *ecdsa.PublicKey) *ecdsa.PublicKey {
+		scans++
+		return crypto.ScanPubSharesA1(bA, S1)
+	}
+	defer func() { scanPubSharesA1 = crypto.ScanPubSharesA1 }()
+
+	a1s1 := testA1S1(b)
+	shares := []pubShareMsg{
+		{senderID: 1, shares: testPubShares(b, 1, 2)},
+		{senderID: 2, shares: testPubShares(b, 2, 2)},
+		{senderID: 3, shares: testPubShares(b, 3, 2)},
+	}
+	defer RemoveA1S1(a1s1)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		delete(a1ScanCache, a1s1)
+		msgMap[a1s1] = shares
+		CheckGetValidA1S1(a1s1)
+
+		if !cached {
+			delete(a1ScanCache, a1s1)
+		}
+		CheckGetValidA1S1(a1s1)
+	}
+	b.ReportMetric(float64(scans)/float64(b.N), "scans/op")
+}
+
+func TestA1ScanCacheLifecycle(t *testing.T) {
+	a1s1 := testA1S1(t)
+	defer RemoveA1S1(a1s1)
+	defer delete(seenNonces, 19)
+
+	for sender := 1; sender <= 2; sender++ {
+		if _, _, err := RegisterPubShareMsg(testPubShareMsg(a1s1, 19, sender, testPubShares(t, int64(sender), 1))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(a1ScanCache[a1s1]) == 0 {
+		t.Fatal("match check didn't memoize its scan")
+	}
+	// A new share invalidates the memoized scans of its a1s1
+	msg := pubShareMsg{certID: 19, senderID: 3, shares: testPubShares(t, 3, 1), nonce: "fresh", received: time.Now()}
+	if err := storePubShareMsg(a1s1, msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a1ScanCache[a1s1]; ok {
+		t.Error("scan scope survived a new share")
+	}
+	CheckGetValidA1S1(a1s1)
+
+	RemoveA1S1(a1s1)
+	if _, ok := msgMap[a1s1]; ok {
+		t.Error("shares survived the removal")
+	}
+	if _, ok := a1ScanCache[a1s1]; ok {
+		t.Error("scan scope survived the removal")
+	}
+	if _, ok := unmatchedPairs[a1s1]; ok {
+		t.Error("unmatched pairs survived the removal")
+	}
+	// Scans of a removed a1s1 aren't memoized
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cachedScanA1(a1s1, &key.PublicKey, &key.PublicKey)
+	if _, ok := a1ScanCache[a1s1]; ok {
+		t.Error("scan memoized for an a1s1 without shares")
+	}
+}
+
+func TestUnmatchedPairsBound(t *testing.T) {
+	a1s1 := testA1S1(t)
+	defer RemoveA1S1(a1s1)
+
+	markUnmatchedPair(a1s1, "pair")
+	if isUnmatchedPair(a1s1, "pair") {
+		t.Error("pair recorded for an a1s1 without shares")
+	}
+	msgMap[a1s1] = []pubShareMsg{{senderID: 1}}
+	for i := 0; i < maxUnmatchedPairs+10; i++ {
+		markUnmatchedPair(a1s1, strconv.Itoa(i))
+	}
+	if have := len(unmatchedPairs[a1s1]); have != maxUnmatchedPairs {
+		t.Errorf("recorded pairs mismatch: have %d, want %d", have, maxUnmatchedPairs)
+	}
+	if !isUnmatchedPair(a1s1, "0") || isUnmatchedPair(a1s1, strconv.Itoa(maxUnmatchedPairs)) {
+		t.Error("pairs past the bound replaced the recorded ones")
+	}
+}
+
+func TestCachedScanA1Unlocked(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stalled, release := make(chan struct{}), make(chan struct{})
+	scanPubSharesA1 = func(bA *ecdsa.PublicKey, S1 *ecdsa.PublicKey) *ecdsa.PublicKey {
+		if bA == S1 {
+			close(stalled)
+			<-release
+		}
+		return bA
+	}
+	defer func() { scanPubSharesA1 = crypto.ScanPubSharesA1 }()
+
+	slow, fast := testA1S1(t), testA1S1(t)
+	defer RemoveA1S1(slow)
+	msgMap[slow] = []pubShareMsg{{senderID: 1}}
+
+	done := make(chan *ecdsa.PublicKey)
+	go func() { done <- cachedScanA1(slow, &key.PublicKey, &key.PublicKey) }()
+	<-stalled
+
+	// A stalled scan doesn't hold up the scans of other a1s1s
+	other, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanned := make(chan struct{})
+	go func() {
+		cachedScanA1(fast, &other.PublicKey, &key.PublicKey)
+		close(scanned)
+	}()
+	select {
+	case <-scanned:
+	case <-time.After(time.Second):
+		t.Fatal("scan blocked behind another one")
+	}
+	close(release)
+	if A1 := <-done; A1 != &key.PublicKey {
+		t.Error("stalled scan returned the wrong point")
+	}
+	if _, ok := a1ScanCache[slow][string(keystore.ECDSAPKCompression(&key.PublicKey))]; !ok {
+		t.Error("stalled scan wasn't memoized")
+	}
+}
+
+func TestAggregateCommitteePubShares(t *testing.T) {
+	// Shares t_i = 5 + 7*i of the secret 5 over the pub set {G, 2G}
+	share := func(id, t int64, pubs ...int64) string {
+		body := sssa.FormatData44bytes(strconv.Itoa(len(pubs)))
+		for _, pub := range pubs {
+			x, y := crypto.S256().ScalarBaseMult(new(big.Int).Mul(big.NewInt(t), big.NewInt(pub)).Bytes())
+			body += sssa.ToBase64(big.NewInt(id)) + sssa.ToBase64(x) + sssa.ToBase64(y)
+		}
+		return body
+	}
+	want := [][2]*big.Int{}
+	for _, pub := range []int64{1, 2} {
+		x, y := crypto.S256().ScalarBaseMult(big.NewInt(5 * pub).Bytes())
+		want = append(want, [2]*big.Int{x, y})
+	}
+
+	for _, members := range [][]int64{{1, 2}, {2, 3}, {1, 2, 3}} {
+		for _, pubs := range [][]int64{{1}, {1, 2}} {
+			shares := make([]string, len(members))
+			for i, id := range members {
+				shares[i] = share(id, 5+7*id, pubs...)
+			}
+			aggregates, err := AggregateCommitteePubSharesAll(shares)
+			if err != nil {
+				t.Fatalf("members %v, %d pubs: %v", members, len(pubs), err)
+			}
+			if len(aggregates) != len(pubs) {
+				t.Fatalf("members %v: have %d aggregates, want %d", members, len(aggregates), len(pubs))
+			}
+			for j, aggregate := range aggregates {
+				if aggregate.X.Cmp(want[j][0]) != 0 || aggregate.Y.Cmp(want[j][1]) != 0 {
+					t.Errorf("members %v: aggregate %d mismatch: have (%x, %x), want %dG", members, j, aggregate.X, aggregate.Y, 5*pubs[j])
+				}
+			}
+		}
+	}
+
+	mixedIDs := sssa.FormatData44bytes("2") + share(2, 19, 1)[44:] + share(3, 26, 2)[44:]
+	offCurve := share(2, 19, 1)[:44+88] + sssa.ToBase64(big.NewInt(1))
+	tests := map[string][]string{
+		"single member":    {share(1, 12, 1)},
+		"count mismatch":   {share(1, 12, 1), sssa.FormatData44bytes("2") + share(2, 19, 1)[44:]},
+		"differing counts": {share(1, 12, 1, 2), share(2, 19, 1)},
+		"mixed member IDs": {share(1, 12, 1, 2), mixedIDs},
+		"duplicate member": {share(1, 12, 1), share(1, 12, 1)},
+		"invalid point":    {share(1, 12, 1), offCurve},
+	}
+	for name, shares := range tests {
+		if _, err := AggregateCommitteePubSharesAll(shares); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+
+	// The single aggregate key of one-point shares
+	aggregate, err := AggregateCommitteePubShares([]string{share(1, 12, 1), share(2, 19, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aggregate.X.Cmp(want[0][0]) != 0 || aggregate.Y.Cmp(want[0][1]) != 0 {
+		t.Errorf("single aggregate mismatch: have (%x, %x), want 5G", aggregate.X, aggregate.Y)
+	}
+	if _, err := AggregateCommitteePubShares([]string{share(1, 12, 1, 2), share(2, 19, 1, 2)}); err == nil {
+		t.Error("several points aggregated into a single key")
+	}
+}
+
+func TestCheckGetValidA1S1WithTimeout(t *testing.T) {
+	a1s1 := testA1S1(t)
+	defer delete(msgMap, a1s1)
+	for sender := 1; sender <= 3; sender++ {
+		if _, _, err := RegisterPubShareMsg(testPubShareMsg(a1s1, 11, sender, testPubShares(t, int64(sender), 2))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer delete(seenNonces, 11)
+
+	matched, err := CheckGetValidA1S1WithTimeout(a1s1, time.Minute)
+	if err != nil || matched {
+		t.Fatalf("unmatched shares: have (%v, %v), want (false, nil)", matched, err)
+	}
+
+	defer func(combine func([]string) (string, error)) { combinePubs = combine }(combinePubs)
+	combinePubs = func(shares []string) (string, error) {
+		time.Sleep(20 * time.Millisecond)
+		return sssa.CombineECDSAPubs(shares)
+	}
+	// Forget the pairs scanned so far to force a full rescan
+	delete(unmatchedPairs, a1s1)
+	if _, err := CheckGetValidA1S1WithTimeout(a1s1, 30*time.Millisecond); err != ErrMatchTimeout {
+		t.Fatalf("slow scan: have %v, want %v", err, ErrMatchTimeout)
+	}
+	// The abandoned scan must not keep the msg store locked
+	msgLock.Lock()
+	msgLock.Unlock()
+}
+
+// testSharePoints returns n random points on the curve.
+func testSharePoints(t testing.TB, n int) []ecdsa.PublicKey {
+	points := make([]ecdsa.PublicKey, n)
+	for i := range points {
+		priv, err := crypto.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		points[i] = priv.PublicKey
+	}
+	return points
+}
+
+func TestAssembleSharePubStr(t *testing.T) {
+	id := sssa.ToBase64(big.NewInt(2))
+	points := testSharePoints(t, 3)
+
+	want := ""
+	for i := range points {
+		want = want + id + sssa.ToBase64(points[i].X) + sssa.ToBase64(points[i].Y)
+	}
+	want = sssa.FormatData44bytes(strconv.Itoa(len(points))) + want
+
+	if have := assembleSharePubStr(id, points); have != want {
+		t.Errorf("pub share string mismatch:\nhave %s\nwant %s", have, want)
+	}
+}
+
+func BenchmarkAssembleSharePubStr(b *testing.B) {
+	id := sssa.ToBase64(big.NewInt(2))
+	points := testSharePoints(b, 100)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		assembleSharePubStr(id, points)
+	}
+}
+
+func TestParsePubShareHeader(t *testing.T) {
+	a1s1 := testA1S1(t)
+	header := BuildPubShareMsg(a1s1, 3, 2, sssa.FormatData44bytes("5"), "")
+
+	gotA1S1, certID, senderID, pubNum, err := ParsePubShareHeader(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotA1S1 != a1s1 || certID != 3 || senderID != 2 || pubNum != 5 {
+		t.Errorf("header mismatch: have (%s, %d, %d, %d), want (%s, 3, 2, 5)", gotA1S1, certID, senderID, pubNum, a1s1)
+	}
+
+	// corrupt replaces the last digit of the field ending at end
+	corrupt := func(end int, c string) string {
+		return header[:end-1] + c + header[end:]
+	}
+	tests := map[string]string{
+		"short":       header[:265],
+		"certID":      corrupt(178, "x"),
+		"senderID":    corrupt(222, "x"),
+		"pubNum":      corrupt(266, "x"),
+		"zero pubNum": header[:222] + sssa.FormatData44bytes("0"),
+		"prefix":      "1x" + header[2:],
+		"A1S1":        header[:2] + "zz" + header[4:],
+	}
+	for name, msg := range tests {
+		if _, _, _, _, err := ParsePubShareHeader(msg); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestSubscribeMatches(t *testing.T) {
+	matches := make(chan MatchEvent, 1)
+	sub := SubscribeMatches(matches)
+	defer sub.Unsubscribe()
+
+	a1s1, bodies := testThresholdA1S1(t, 2, 5)
+	defer RemoveA1S1(a1s1)
+	defer delete(seenNonces, 13)
+	for _, sender := range []int{5, 2} {
+		if _, _, err := RegisterPubShareMsg(testPubShareMsg(a1s1, 13, sender, bodies[int64(sender)])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case ev := <-matches:
+		want := MatchEvent{A1S1: a1s1, CertID: 13, Senders: [2]int{2, 5}}
+		if ev != want {
+			t.Errorf("match event mismatch: have %+v, want %+v", ev, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no match event received")
+	}
+	// Checking the matched a1s1 again doesn't publish it twice
+	if !CheckGetValidA1S1(a1s1) {
+		t.Fatal("matched a1s1 no longer matches")
+	}
+	select {
+	case ev := <-matches:
+		t.Errorf("match published twice: %+v", ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestStalledMatchSubscriber(t *testing.T) {
+	stalled := make(chan MatchEvent)
+	sub := SubscribeMatches(stalled)
+	defer sub.Unsubscribe()
+
+	dropped := DroppedMatchEvents()
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < matchQueueSize+2; i++ {
+			publishMatch(MatchEvent{CertID: i})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("match publishing blocked on a stalled subscriber")
+	}
+	// The forwarder holds one event, the queue the next matchQueueSize
+	if have := DroppedMatchEvents() - dropped; have < 1 || have > 2 {
+		t.Errorf("dropped events mismatch: have %d, want 1 or 2", have)
+	}
+	if ev := <-stalled; ev.CertID != 0 {
+		t.Errorf("first event mismatch: have %d, want 0", ev.CertID)
+	}
+}
+
+func TestIncrementalMatching(t *testing.T) {
+	a1s1 := testA1S1(t)
+	defer delete(msgMap, a1s1)
+	defer delete(seenNonces, 17)
+
+	defer func(combine func([]string) (string, error)) { combinePubs = combine }(combinePubs)
+	attempts := 0
+	combinePubs = func(shares []string) (string, error) {
+		attempts++
+		return sssa.CombineECDSAPubs(shares)
+	}
+	for sender := 1; sender <= 4; sender++ {
+		attempts = 0
+		if _, matched, err := RegisterPubShareMsg(testPubShareMsg(a1s1, 17, sender, testPubShares(t, int64(sender), 1))); err != nil || matched {
+			t.Fatalf("sender %d: have (%v, %v), want (false, nil)", sender, matched, err)
+		}
+		// Only the new share is tried against each of the stored ones
+		if attempts != sender-1 {
+			t.Errorf("sender %d: have %d combination attempts, want %d", sender, attempts, sender-1)
+		}
+	}
+	attempts = 0
+	if CheckGetValidA1S1(a1s1) {
+		t.Fatal("unexpected match")
+	}
+	if attempts != 0 {
+		t.Errorf("rescan without new shares: have %d combination attempts, want 0", attempts)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2018 The go-usechain Authors
+// This file is part of the go-usechain library.
+//
+// The go-usechain library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-usechain library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-usechain library. If not, see <http://www.gnu.org/licenses/>.
+
+package committee
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/big"
+
+	"github.com/usechain/go-usechain/common"
+	"github.com/usechain/go-usechain/core/state"
+)
+
+/*
+ *  The storage keys of the authentication contract read by ReadUnconfirmedAddress
+ *  Exposed so external verifiers can request Merkle proofs (eth_getProof) of the slots
+ */
+
+// The part of the state database the contract storage is read through
+type stateReader interface {
+	GetState(addr common.Address, hash common.Hash) common.Hash
+}
+
+// The fields of a certificate entry in the contract
+const (
+	certRingSigField = 1
+	certPubSKeyField = 2
+)
+
+/*
+ * Return the storage key holding the certID of the index-th unconfirmed address
+ */
+func UnconfirmedAddressStorageKey(index int64) (common.Hash, error) {
+	key, err := state.ExpandToIndex(state.UnConfirmedAddress, "", index)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return common.HexToHash(key), nil
+}
+
+/*
+ * Return the storage key holding the certificate address of the certID
+ */
+func CertToAddressStorageKey(certID int64) (common.Hash, error) {
+	return certToAddressKey(common.BigToHash(big.NewInt(certID)))
+}
+
+/*
+ * Return the storage keys of the ring sig stored for a certificate address
+ * certAddr is the word read from the CertToAddress slot, lenKey holds the length
+ * of the ring sig, dataKeys the words of the ring sig itself
+ */
+func RingSigStorageKeys(certAddr common.Hash, length int64) (lenKey common.Hash, dataKeys []common.Hash, err error) {
+	return certFieldKeys(certAddr, certRingSigField, length)
+}
+
+/*
+ * Return the storage keys of the pubSkey stored for a certificate address
+ * The keys are laid out as for RingSigStorageKeys
+ */
+func PubSKeyStorageKeys(certAddr common.Hash, length int64) (lenKey common.Hash, dataKeys []common.Hash, err error) {
+	return certFieldKeys(certAddr, certPubSKeyField, length)
+}
+
+// certToAddressKey computes the CertToAddress slot of a certID word as read from the contract
+func certToAddressKey(certID common.Hash) (common.Hash, error) {
+	key, err := state.ExpandToIndex(state.CertToAddress, hex.EncodeToString(certID[:]), 0)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return common.HexToHash(key), nil
+}
+
+// certFieldLenKey computes the slot of a certificate field holding the field length
+func certFieldLenKey(certAddr common.Hash, field int64) (string, error) {
+	addr := hex.EncodeToString(certAddr[:])
+	return state.ExpandToIndex(state.CertificateAddr, "00"+addr[:len(addr)-2], field)
+}
+
+// certFieldDataKey computes the slot of the word-th word of a certificate field
+func certFieldDataKey(lenKey string, word int64) common.Hash {
+	return common.HexToHash(state.IncreaseHexByNum(state.CalculateStateDbIndex(lenKey, ""), word))
+}
+
+// certFieldKeys computes the length slot and the data slots of a certificate field
+// The length is the value of the length slot, in hex chars as stored by the contract,
+// and is checked against MaxDynamicBytes before any slot is computed
+func certFieldKeys(certAddr common.Hash, field int64, length int64) (common.Hash, []common.Hash, error) {
+	if err := checkDynamicLength(length); err != nil {
+		return common.Hash{}, nil, err
+	}
+	lenKey, err := certFieldLenKey(certAddr, field)
+	if err != nil {
+		return common.Hash{}, nil, err
+	}
+	words := length / (int64(common.HashLength) * 2)
+	dataKeys := make([]common.Hash, 0, words+1)
+	for j := int64(0); j <= words; j++ {
+		dataKeys = append(dataKeys, certFieldDataKey(lenKey, j))
+	}
+	return common.HexToHash(lenKey), dataKeys, nil
+}
+
+// checkDynamicLength validates the length of a dynamic bytes field, in hex chars
+func checkDynamicLength(length int64) error {
+	if length < 0 {
+		return fmt.Errorf("invalid dynamic bytes length %d", length)
+	}
+	if max := currentLimits().MaxDynamicBytes; length/2 > int64(max) {
+		return &LimitExceededError{Limit: "dynamic bytes", Have: int(length / 2), Max: max}
+	}
+	return nil
+}
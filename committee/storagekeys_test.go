@@ -0,0 +1,80 @@
+// Copyright 2018 The go-usechain Authors
+// This file is part of the go-usechain library.
+//
+// The go-usechain library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-usechain library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-usechain library. If not, see <http://www.gnu.org/licenses/>.
+
+package committee
+
+import (
+	"encoding/hex"
+	"math/big"
+	"testing"
+
+	"github.com/usechain/go-usechain/common"
+	"github.com/usechain/go-usechain/core/state"
+)
+
+// The storage keys must be those ReadUnconfirmedAddress derives from the contract words
+func TestCertToAddressStorageKey(t *testing.T) {
+	for _, certID := range []int64{0, 1, 21, 1 << 40} {
+		word := common.BigToHash(big.NewInt(certID))
+		want, err := state.ExpandToIndex(state.CertToAddress, hex.EncodeToString(word[:]), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		have, err := CertToAddressStorageKey(certID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have != common.HexToHash(want) {
+			t.Errorf("certID %d: have %x, want %s", certID, have, want)
+		}
+	}
+	want, _ := state.ExpandToIndex(state.UnConfirmedAddress, "", 3)
+	if have, _ := UnconfirmedAddressStorageKey(3); have != common.HexToHash(want) {
+		t.Errorf("unconfirmed address key: have %x, want %s", have, want)
+	}
+}
+
+func TestCertFieldStorageKeys(t *testing.T) {
+	certAddr := common.HexToHash("0x7e5e0b8d37fd1cd7ea7fa0d9ab9d0c62a7bd6a1f00")
+	addr := hex.EncodeToString(certAddr[:])
+
+	for field, keys := range map[int64]func(common.Hash, int64) (common.Hash, []common.Hash, error){
+		certRingSigField: RingSigStorageKeys,
+		certPubSKeyField: PubSKeyStorageKeys,
+	} {
+		lenKey, err := state.ExpandToIndex(state.CertificateAddr, "00"+addr[:len(addr)-2], field)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 130 hex chars span three words
+		haveLen, haveData, err := keys(certAddr, 130)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if haveLen != common.HexToHash(lenKey) {
+			t.Errorf("field %d length key: have %x, want %s", field, haveLen, lenKey)
+		}
+		if len(haveData) != 3 {
+			t.Fatalf("field %d: have %d data keys, want 3", field, len(haveData))
+		}
+		for j, have := range haveData {
+			want := state.IncreaseHexByNum(state.CalculateStateDbIndex(lenKey, ""), int64(j))
+			if have != common.HexToHash(want) {
+				t.Errorf("field %d word %d: have %x, want %s", field, j, have, want)
+			}
+		}
+	}
+}
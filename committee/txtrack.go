@@ -0,0 +1,119 @@
+// Copyright 2018 The go-usechain Authors
+// This file is part of the go-usechain library.
+//
+// The go-usechain library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-usechain library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-usechain library. If not, see <http://www.gnu.org/licenses/>.
+
+package committee
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/usechain/go-usechain/common"
+	"github.com/usechain/go-usechain/core"
+	"github.com/usechain/go-usechain/eth"
+)
+
+// The status of a submitted committee tx
+type TxStatus int
+
+const (
+	TxPending TxStatus = iota // In the pool, waiting to be mined
+	TxMined                   // Included in the canonical chain
+	TxDropped                 // Neither in the pool nor on chain, evicted or replaced
+)
+
+func (s TxStatus) String() string {
+	switch s {
+	case TxPending:
+		return "pending"
+	case TxMined:
+		return "mined"
+	case TxDropped:
+		return "dropped"
+	}
+	return fmt.Sprintf("TxStatus(%d)", int(s))
+}
+
+// The interval the tracked txs are polled at
+var txTrackInterval = 3 * time.Second
+
+/*
+ *  The part of the node a tx is tracked through
+ */
+type txBackend interface {
+	InPool(hash common.Hash) bool
+	Mined(hash common.Hash) bool
+}
+
+type ethTxBackend struct {
+	usechain *eth.Ethereum
+}
+
+func (b ethTxBackend) InPool(hash common.Hash) bool {
+	return b.usechain.TxPool().Get(hash) != nil
+}
+
+func (b ethTxBackend) Mined(hash common.Hash) bool {
+	tx, _, _, _ := core.GetTransaction(b.usechain.ChainDb(), hash)
+	return tx != nil
+}
+
+/*
+ *  Watch a committee tx submitted by AddLocal until it's mined or dropped
+ *  Every status change is emitted, the channel is closed after TxMined or
+ *  TxDropped, or once ctx is done
+ *  A supervising loop resubmits the msg on TxDropped
+ */
+func TrackCommitteeTx(ctx context.Context, usechain *eth.Ethereum, hash common.Hash) <-chan TxStatus {
+	return trackTx(ctx, ethTxBackend{usechain}, hash, txTrackInterval)
+}
+
+func trackTx(ctx context.Context, backend txBackend, hash common.Hash, interval time.Duration) <-chan TxStatus {
+	// Buffered for every status, so the tracker never blocks on a slow reader
+	updates := make(chan TxStatus, 3)
+	go func() {
+		defer close(updates)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		last := TxStatus(-1)
+		for {
+			// The pool drops a mined tx only after the block is written,
+			// so a tx missing from the pool is on chain if it was mined
+			status := TxPending
+			if !backend.InPool(hash) {
+				status = TxDropped
+				if backend.Mined(hash) {
+					status = TxMined
+				}
+			}
+			if status != last {
+				updates <- status
+				last = status
+			}
+			if status != TxPending {
+				return
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return updates
+}
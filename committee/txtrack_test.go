@@ -0,0 +1,103 @@
+// Copyright 2018 The go-usechain Authors
+// This file is part of the go-usechain library.
+//
+// The go-usechain library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-usechain library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-usechain library. If not, see <http://www.gnu.org/licenses/>.
+
+package committee
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/usechain/go-usechain/common"
+)
+
+// testTxBackend reports a tx pending for a number of polls, then mined or dropped
+type testTxBackend struct {
+	pendingPolls int
+	mined        bool
+	lock         sync.Mutex
+}
+
+func (b *testTxBackend) InPool(hash common.Hash) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.pendingPolls == 0 {
+		return false
+	}
+	b.pendingPolls--
+	return true
+}
+
+func (b *testTxBackend) Mined(hash common.Hash) bool {
+	return b.mined
+}
+
+func collectTxStatus(t *testing.T, updates <-chan TxStatus) []TxStatus {
+	var statuses []TxStatus
+	for {
+		select {
+		case status, ok := <-updates:
+			if !ok {
+				return statuses
+			}
+			statuses = append(statuses, status)
+		case <-time.After(time.Second):
+			t.Fatalf("tracker not finished, statuses so far %v", statuses)
+		}
+	}
+}
+
+func TestTrackTx(t *testing.T) {
+	hash := common.HexToHash("0x01")
+	tests := []struct {
+		backend *testTxBackend
+		want    []TxStatus
+	}{
+		{&testTxBackend{pendingPolls: 3}, []TxStatus{TxPending, TxDropped}},
+		{&testTxBackend{pendingPolls: 2, mined: true}, []TxStatus{TxPending, TxMined}},
+		{&testTxBackend{mined: true}, []TxStatus{TxMined}},
+		{&testTxBackend{}, []TxStatus{TxDropped}},
+	}
+	for i, test := range tests {
+		have := collectTxStatus(t, trackTx(context.Background(), test.backend, hash, time.Millisecond))
+		if len(have) != len(test.want) {
+			t.Errorf("test %d: have statuses %v, want %v", i, have, test.want)
+			continue
+		}
+		for j := range have {
+			if have[j] != test.want[j] {
+				t.Errorf("test %d: have statuses %v, want %v", i, have, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestTrackTxCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	backend := &testTxBackend{pendingPolls: -1}
+	updates := trackTx(ctx, backend, common.HexToHash("0x01"), time.Millisecond)
+
+	if status := <-updates; status != TxPending {
+		t.Fatalf("first status mismatch: have %v, want %v", status, TxPending)
+	}
+	cancel()
+	if have := collectTxStatus(t, updates); len(have) != 0 {
+		t.Errorf("statuses after cancel: %v", have)
+	}
+}
@@ -449,7 +449,7 @@ func TestLibraryCombine4() {
 
 	a1s1 := "0263066721be0b345c6f6717f9c4ce9c13acab2012882f70c5a43935cbcf8045cd03a94e9653042091c7bec1b24630aa955bb50bc80ededdd7fb0d2c0f40aeadd8a9"
 	sbyte,_:=hexutil.Decode("0x" + a1s1)
-	A1, S1, err := keystore.GeneratePKPairFromABaddress(sbyte[:])
+	A1, S1, err := keystore.ParseABaddress(sbyte)
 	if err !=nil {
 		fmt.Println("A1S1 decode failed!", err)
 		return